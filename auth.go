@@ -0,0 +1,316 @@
+package sunrpc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rasky/go-xdr/xdr2"
+)
+
+// Limits imposed by RFC 5531 on AUTH_UNIX credentials.
+const (
+	authUnixMaxMachineName = 255
+	authUnixMaxGids        = 16
+)
+
+// Authenticator implements an authentication flavor. Clients and servers look up the
+// Authenticator registered for the flavor of the credentials they handle, to encode and
+// decode them, and to produce and validate the verifiers that accompany them.
+type Authenticator interface {
+	// EncodeCred encodes credentials into the body of an OpaqueAuth.
+	EncodeCred(cred interface{}) ([]byte, error)
+
+	// DecodeCred decodes the body of an OpaqueAuth into credentials.
+	DecodeCred(body []byte) (interface{}, error)
+
+	// Verifier returns the verifier to send along with a message authenticated with cred:
+	// clients attach it to calls, servers to replies.
+	Verifier(cred interface{}) (OpaqueAuth, error)
+
+	// ValidateVerifier checks the verifier received along with a message authenticated
+	// with cred: servers validate the verifier of calls, clients the one of replies.
+	ValidateVerifier(cred interface{}, verf OpaqueAuth) error
+}
+
+var (
+	authMu         sync.RWMutex
+	authenticators = map[AuthFlavor]Authenticator{
+		AuthFlavorNone:  authNone{},
+		AuthFlavorUnix:  authUnix{},
+		AuthFlavorShort: authShort{},
+	}
+)
+
+// RegisterAuthenticator registers the Authenticator for a flavor, replacing the previous one
+// (if any). AUTH_NONE, AUTH_UNIX and AUTH_SHORT are registered by default.
+func RegisterAuthenticator(flavor AuthFlavor, auth Authenticator) {
+	authMu.Lock()
+	authenticators[flavor] = auth
+	authMu.Unlock()
+}
+
+// LookupAuthenticator returns the Authenticator registered for a flavor.
+func LookupAuthenticator(flavor AuthFlavor) (Authenticator, error) {
+	authMu.RLock()
+	auth, found := authenticators[flavor]
+	authMu.RUnlock()
+
+	if !found {
+		return nil, fmt.Errorf("unsupported authentication flavor: %v", flavor)
+	}
+	return auth, nil
+}
+
+// NewOpaqueAuth encodes credentials of the specified flavor, using the registered Authenticator.
+func NewOpaqueAuth(flavor AuthFlavor, cred interface{}) (OpaqueAuth, error) {
+	auth, err := LookupAuthenticator(flavor)
+	if err != nil {
+		return OpaqueAuth{}, err
+	}
+
+	body, err := auth.EncodeCred(cred)
+	if err != nil {
+		return OpaqueAuth{}, err
+	}
+
+	return OpaqueAuth{Flavor: flavor, Body: body}, nil
+}
+
+// Decode decodes the body of the OpaqueAuth, using the Authenticator registered for its flavor.
+func (o *OpaqueAuth) Decode() (interface{}, error) {
+	auth, err := LookupAuthenticator(o.Flavor)
+	if err != nil {
+		return nil, err
+	}
+	return auth.DecodeCred(o.Body)
+}
+
+// authNone implements AUTH_NONE; credentials are decoded as AuthNone.
+type authNone struct{}
+
+func (authNone) EncodeCred(cred interface{}) ([]byte, error) { return nil, nil }
+
+func (authNone) DecodeCred(body []byte) (interface{}, error) { return AuthNone{}, nil }
+
+func (authNone) Verifier(cred interface{}) (OpaqueAuth, error) {
+	return OpaqueAuth{Flavor: AuthFlavorNone}, nil
+}
+
+func (authNone) ValidateVerifier(cred interface{}, verf OpaqueAuth) error {
+	if verf.Flavor != AuthFlavorNone {
+		return errors.New("unexpected verifier for AUTH_NONE")
+	}
+	return nil
+}
+
+// authUnix implements AUTH_UNIX; credentials are decoded as AuthUnix.
+type authUnix struct{}
+
+func (authUnix) EncodeCred(cred interface{}) ([]byte, error) {
+	var unix *AuthUnix
+	switch c := cred.(type) {
+	case AuthUnix:
+		unix = &c
+	case *AuthUnix:
+		unix = c
+	default:
+		return nil, fmt.Errorf("invalid AUTH_UNIX credentials: %T", cred)
+	}
+
+	if len(unix.MachineName) > authUnixMaxMachineName {
+		return nil, errors.New("AUTH_UNIX machine name is too long")
+	}
+	if len(unix.Gids) > authUnixMaxGids {
+		return nil, errors.New("AUTH_UNIX credentials have too many gids")
+	}
+
+	var buf bytes.Buffer
+	if _, err := xdr.Marshal(&buf, unix); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (authUnix) DecodeCred(body []byte) (interface{}, error) {
+	auth := AuthUnix{}
+	if _, err := xdr.Unmarshal(bytes.NewReader(body), &auth); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+func (authUnix) Verifier(cred interface{}) (OpaqueAuth, error) {
+	return OpaqueAuth{Flavor: AuthFlavorNone}, nil
+}
+
+func (authUnix) ValidateVerifier(cred interface{}, verf OpaqueAuth) error {
+	// Servers can reply with an AUTH_SHORT verifier, see ClientAuthUnix
+	if verf.Flavor != AuthFlavorNone && verf.Flavor != AuthFlavorShort {
+		return errors.New("unexpected verifier for AUTH_UNIX")
+	}
+	return nil
+}
+
+// ClientAuth provides the credentials attached by a Client to its calls (see ClientConfig.Auth).
+type ClientAuth interface {
+	// Auth returns the credentials and the verifier to send along with a new call.
+	Auth() (cred, verf OpaqueAuth, err error)
+}
+
+// ClientAuthValidator is implemented by a ClientAuth that wants to check the verifier of
+// the replies; if it returns an error, the call fails with it.
+type ClientAuthValidator interface {
+	ValidateVerifier(cred, verf OpaqueAuth) error
+}
+
+// ClientAuthRefresher is implemented by a ClientAuth caching some state negotiated with the
+// server (such as an AUTH_SHORT handle). When a call is rejected with an authentication error,
+// Refresh is invoked with its status; if it returns true, the call is retried once.
+type ClientAuthRefresher interface {
+	Refresh(stat AuthStat) bool
+}
+
+// NewClientAuth creates a ClientAuth sending the specified credentials, using the
+// Authenticator registered for their flavor.
+func NewClientAuth(flavor AuthFlavor, cred interface{}) ClientAuth {
+	return &clientAuth{flavor: flavor, cred: cred}
+}
+
+type clientAuth struct {
+	flavor AuthFlavor
+	cred   interface{}
+}
+
+func (a *clientAuth) Auth() (cred, verf OpaqueAuth, err error) {
+	return authWithVerifier(a.flavor, a.cred)
+}
+
+func (a *clientAuth) ValidateVerifier(cred, verf OpaqueAuth) error {
+	return validateVerifier(a.flavor, a.cred, verf)
+}
+
+// authWithVerifier encodes credentials and produces their verifier.
+func authWithVerifier(flavor AuthFlavor, c interface{}) (cred, verf OpaqueAuth, err error) {
+	auth, err := LookupAuthenticator(flavor)
+	if err != nil {
+		return cred, verf, err
+	}
+
+	body, err := auth.EncodeCred(c)
+	if err != nil {
+		return cred, verf, err
+	}
+
+	verf, err = auth.Verifier(c)
+	if err != nil {
+		return cred, verf, err
+	}
+
+	return OpaqueAuth{Flavor: flavor, Body: body}, verf, nil
+}
+
+func validateVerifier(flavor AuthFlavor, cred interface{}, verf OpaqueAuth) error {
+	auth, err := LookupAuthenticator(flavor)
+	if err != nil {
+		return err
+	}
+	return auth.ValidateVerifier(cred, verf)
+}
+
+// ClientAuthUnix is a ClientAuth sending AUTH_UNIX (also known as AUTH_SYS) credentials,
+// as required by servers such as NFS or mountd.
+//
+// If the server issues an AUTH_SHORT handle, it is sent in place of the full credentials
+// until the server rejects it. As the handle is only valid for the server that issued it,
+// a ClientAuthUnix must not be shared among clients of different servers.
+type ClientAuthUnix struct {
+	MachineName string
+	Uid, Gid    uint32
+	Gids        []uint32
+
+	mu    sync.Mutex
+	short []byte // AUTH_SHORT handle issued by the server (if any)
+}
+
+// NewClientAuthUnix creates AUTH_UNIX credentials describing the current process: the local
+// hostname, and the user and group ids it is running with.
+func NewClientAuthUnix() *ClientAuthUnix {
+	name, _ := os.Hostname()
+	if len(name) > authUnixMaxMachineName {
+		name = name[:authUnixMaxMachineName]
+	}
+
+	var gids []uint32
+	groups, _ := os.Getgroups()
+	for _, g := range groups {
+		if len(gids) == authUnixMaxGids {
+			break
+		}
+		gids = append(gids, uint32(g))
+	}
+
+	return &ClientAuthUnix{
+		MachineName: name,
+		Uid:         uint32(os.Getuid()),
+		Gid:         uint32(os.Getgid()),
+		Gids:        gids,
+	}
+}
+
+// Auth encodes the AUTH_UNIX credentials, stamped with the current time, or the AUTH_SHORT
+// handle issued by the server.
+func (a *ClientAuthUnix) Auth() (cred, verf OpaqueAuth, err error) {
+	a.mu.Lock()
+	short := a.short
+	a.mu.Unlock()
+
+	if short != nil {
+		return authWithVerifier(AuthFlavorShort, AuthShort{Handle: short})
+	}
+	return authWithVerifier(AuthFlavorUnix, a.authUnix())
+}
+
+// ValidateVerifier validates the reply verifier, and caches the AUTH_SHORT handle it carries (if any).
+func (a *ClientAuthUnix) ValidateVerifier(cred, verf OpaqueAuth) error {
+	c, err := cred.Decode()
+	if err != nil {
+		return err
+	}
+	if err := validateVerifier(cred.Flavor, c, verf); err != nil {
+		return err
+	}
+
+	if verf.Flavor == AuthFlavorShort {
+		a.mu.Lock()
+		a.short = append([]byte(nil), verf.Body...)
+		a.mu.Unlock()
+	}
+	return nil
+}
+
+// Refresh drops the AUTH_SHORT handle when the server rejects it, so that the full credentials
+// are sent again.
+func (a *ClientAuthUnix) Refresh(stat AuthStat) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if stat != AuthRejectedCred || a.short == nil {
+		return false
+	}
+	a.short = nil
+	return true
+}
+
+func (a *ClientAuthUnix) authUnix() *AuthUnix {
+	return &AuthUnix{
+		Stamp:       uint32(time.Now().Unix()),
+		MachineName: a.MachineName,
+		Uid:         a.Uid,
+		Gid:         a.Gid,
+		Gids:        a.Gids,
+	}
+}
@@ -0,0 +1,295 @@
+package sunrpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientAuthUnix(t *testing.T) {
+	var mu sync.Mutex
+	var creds []interface{}
+	addr := startFakeServer(t, func(call *ProcedureCall, body io.Reader) ([]byte, bool) {
+		cred, err := call.Body.Cred.Decode()
+		assert.Nil(t, err)
+		assert.Equal(t, AuthFlavorNone, call.Body.Verf.Flavor)
+		mu.Lock()
+		creds = append(creds, cred)
+		mu.Unlock()
+		return fakeReply(t, call, nil), true
+	})
+
+	auth := &ClientAuthUnix{
+		MachineName: "host",
+		Uid:         1000,
+		Gid:         100,
+		Gids:        []uint32{100, 27},
+	}
+
+	client := NewClient(addr, 1, 1, &ClientConfig{Transport: ClientTransportTcpOnly, Auth: auth})
+	defer client.Close()
+
+	assert.Nil(t, client.Call(1, nil, nil))
+	mu.Lock()
+	defer mu.Unlock()
+	if assert.Len(t, creds, 2) {
+		unix, ok := creds[1].(AuthUnix)
+		if assert.True(t, ok) {
+			assert.NotZero(t, unix.Stamp)
+			assert.Equal(t, "host", unix.MachineName)
+			assert.EqualValues(t, 1000, unix.Uid)
+			assert.EqualValues(t, 100, unix.Gid)
+			assert.Equal(t, []uint32{100, 27}, unix.Gids)
+		}
+	}
+
+	auth.Gids = make([]uint32, 17)
+	assert.NotNil(t, client.Call(1, nil, nil))
+}
+
+func TestNewClientAuthUnix(t *testing.T) {
+	auth := NewClientAuthUnix()
+
+	cred, verf, err := auth.Auth()
+	assert.Nil(t, err)
+	assert.Equal(t, AuthFlavorUnix, cred.Flavor)
+	assert.Equal(t, AuthFlavorNone, verf.Flavor)
+	assert.True(t, len(auth.Gids) <= 16)
+}
+
+const authFlavorTest AuthFlavor = 0x40000000
+
+// authTest is a test flavor: credentials are plain strings, and verifiers echo them back.
+type authTest struct{}
+
+func (authTest) EncodeCred(cred interface{}) ([]byte, error) { return []byte(cred.(string)), nil }
+
+func (authTest) DecodeCred(body []byte) (interface{}, error) { return string(body), nil }
+
+func (authTest) Verifier(cred interface{}) (OpaqueAuth, error) {
+	return OpaqueAuth{Flavor: authFlavorTest, Body: []byte(cred.(string))}, nil
+}
+
+func (authTest) ValidateVerifier(cred interface{}, verf OpaqueAuth) error {
+	if verf.Flavor != authFlavorTest || string(verf.Body) != cred.(string) {
+		return errors.New("invalid verifier")
+	}
+	return nil
+}
+
+// roundTripRecord performs a call through the client against the server, without going
+// through the network.
+func roundTripRecord(t *testing.T, c *Client, s *server, proc uint32, args, reply interface{}) error {
+	pcall, err := c.newCall(c.Program, c.Version, proc)
+	if err != nil {
+		return err
+	}
+	payload, err := encodeCall(pcall, args, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replyBuf, err := s.handleRecord(CallContext{Context: context.Background()}, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.readReply(&replyBuf, pcall, reply)
+}
+
+func TestAuthenticatorRegistry(t *testing.T) {
+	RegisterAuthenticator(authFlavorTest, authTest{})
+	t.Cleanup(func() {
+		authMu.Lock()
+		delete(authenticators, authFlavorTest)
+		authMu.Unlock()
+	})
+
+	s := newServer(1, 1, nil)
+	s.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg + 1
+		return nil
+	})
+	s.SetAuth(func(proc uint32, cred interface{}) bool {
+		return cred == "secret"
+	})
+
+	var reply uint32
+	client := NewClient("", 1, 1, &ClientConfig{Auth: NewClientAuth(authFlavorTest, "secret")})
+	assert.Nil(t, roundTripRecord(t, client, &s, 1, uint32(41), &reply))
+	assert.EqualValues(t, 42, reply)
+
+	client = NewClient("", 1, 1, &ClientConfig{Auth: NewClientAuth(authFlavorTest, "wrong")})
+	err := roundTripRecord(t, client, &s, 1, uint32(41), &reply)
+	assert.Equal(t, &ErrAuth{Stat: AuthBadCred}, err)
+
+	client = NewClient("", 1, 1, &ClientConfig{Auth: NewClientAuthUnix()})
+	err = roundTripRecord(t, client, &s, 1, uint32(41), &reply)
+	assert.Equal(t, &ErrAuth{Stat: AuthBadCred}, err)
+
+	cred, err := NewOpaqueAuth(authFlavorTest, "secret")
+	assert.Nil(t, err)
+	decoded, err := cred.Decode()
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", decoded)
+
+	_, err = (&OpaqueAuth{Flavor: AuthFlavorDes}).Decode()
+	assert.NotNil(t, err)
+}
+
+func TestAuthShort(t *testing.T) {
+	srv := NewTCPServer(1, 1).(*TCPServer)
+	srv.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	srv.Register(1, func(arg struct{}, reply *struct{}) error { return nil })
+	srv.SetAuthShort(time.Minute)
+
+	var mu sync.Mutex
+	var creds []interface{}
+	srv.SetAuth(func(proc uint32, cred interface{}) bool {
+		mu.Lock()
+		creds = append(creds, cred)
+		mu.Unlock()
+		return true
+	})
+
+	auth := &ClientAuthUnix{MachineName: "host", Uid: 1000}
+	client := NewClient(serveTCP(t, srv), 1, 1, &ClientConfig{Transport: ClientTransportTcpOnly, Auth: auth})
+	defer client.Close()
+
+	// The ping sends the full credentials, and receives a short handle
+	assert.Nil(t, client.Call(1, nil, nil))
+	handle := auth.short
+	assert.Len(t, handle, authShortHandleSize)
+
+	// The handle is used from now on
+	cred, _, err := auth.Auth()
+	assert.Nil(t, err)
+	assert.Equal(t, AuthFlavorShort, cred.Flavor)
+
+	// If the server forgets about the handle, the client falls back to the full credentials
+	srv.SetAuthShort(time.Minute)
+	assert.Nil(t, client.Call(1, nil, nil))
+	assert.Len(t, auth.short, authShortHandleSize)
+	assert.NotEqual(t, handle, auth.short)
+
+	// The server always sees the full credentials
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Len(t, creds, 3)
+	for _, c := range creds {
+		if unix, ok := c.(AuthUnix); assert.True(t, ok) {
+			assert.Equal(t, "host", unix.MachineName)
+			assert.EqualValues(t, 1000, unix.Uid)
+		}
+	}
+}
+
+func TestSetAuthShortWhileServing(t *testing.T) {
+	srv := NewTCPServer(1, 1).(*TCPServer)
+	srv.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	srv.SetAuthShort(time.Minute)
+
+	auth := &ClientAuthUnix{MachineName: "host", Uid: 1000}
+	client := NewClient(serveTCP(t, srv), 1, 1, &ClientConfig{Transport: ClientTransportTcpOnly, Auth: auth, Pipelined: true})
+	defer client.Close()
+
+	// Calls keep succeeding while the handles are reset, falling back to the full credentials
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				assert.Nil(t, client.Call(0, nil, nil))
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		srv.SetAuthShort(time.Minute)
+	}
+	wg.Wait()
+}
+
+func TestAuthShortRejectedWire(t *testing.T) {
+	s := newServer(1, 1, nil)
+	s.Register(1, func(arg struct{}, reply *struct{}) error { return nil })
+	s.SetAuthShort(time.Minute)
+
+	// Unknown handles are rejected with AUTH_REJECTEDCRED (2), as defined by RFC 5531, so that
+	// any client falls back to its full credentials
+	auth := &ClientAuthUnix{MachineName: "host", short: make([]byte, authShortHandleSize)}
+	client := NewClient("", 1, 1, &ClientConfig{Auth: auth})
+	pcall, err := client.newCall(1, 1, 1)
+	assert.Nil(t, err)
+	payload, err := encodeCall(pcall, nil, true)
+	assert.Nil(t, err)
+	reply, err := s.handleRecord(CallContext{Context: context.Background()}, payload)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []byte{
+		0, 0, 0, 1, // REPLY
+		0, 0, 0, 1, // MSG_DENIED
+		0, 0, 0, 1, // AUTH_ERROR
+		0, 0, 0, 2, // AUTH_REJECTEDCRED
+	}, reply.Bytes()[4:])
+}
+
+func TestAuthShortCacheExpiry(t *testing.T) {
+	cache := newAuthShortCache(10 * time.Millisecond)
+	cred := OpaqueAuth{Flavor: AuthFlavorUnix, Body: []byte{1, 2, 3}}
+
+	handle, err := cache.issue(cred)
+	assert.Nil(t, err)
+
+	resolved, found := cache.resolve(handle)
+	assert.True(t, found)
+	assert.Equal(t, cred, resolved)
+
+	time.Sleep(20 * time.Millisecond)
+	_, found = cache.resolve(handle)
+	assert.False(t, found)
+}
+
+func TestAuthShortCacheReuse(t *testing.T) {
+	cache := newAuthShortCache(time.Minute)
+	cache.maxEntries = 2
+	unixCred := func(stamp, uid uint32) OpaqueAuth {
+		cred, err := NewOpaqueAuth(AuthFlavorUnix, AuthUnix{Stamp: stamp, MachineName: "host", Uid: uid, Gids: []uint32{uid}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cred
+	}
+	cred1 := unixCred(1, 1000)
+	cred2 := unixCred(1, 1001)
+	cred3 := OpaqueAuth{Flavor: authFlavorTest, Body: []byte{7, 8, 9}}
+
+	// The same handle is issued for the same identity, even if the stamp changes
+	handle1, err := cache.issue(cred1)
+	assert.Nil(t, err)
+	again, err := cache.issue(unixCred(2, 1000))
+	assert.Nil(t, err)
+	assert.Equal(t, handle1, again)
+	assert.Len(t, cache.entries, 1)
+
+	handle2, err := cache.issue(cred2)
+	assert.Nil(t, err)
+	assert.NotEqual(t, handle1, handle2)
+	assert.Len(t, cache.entries, 2)
+
+	// When the cache is full, the least recently used entry is evicted
+	_, found := cache.resolve(handle1)
+	assert.True(t, found)
+	_, err = cache.issue(cred3)
+	assert.Nil(t, err)
+	assert.Len(t, cache.entries, 2)
+	assert.Len(t, cache.handles, 2)
+
+	_, found = cache.resolve(handle1)
+	assert.True(t, found)
+	_, found = cache.resolve(handle2)
+	assert.False(t, found)
+}
@@ -0,0 +1,164 @@
+package sunrpc
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// authShortHandleSize is the size of the AUTH_SHORT handles issued by servers.
+const authShortHandleSize = 16
+
+// authShort implements AUTH_SHORT; credentials are decoded as AuthShort. Servers resolve
+// them back to the full credentials through their authShortCache.
+type authShort struct{}
+
+func (authShort) EncodeCred(cred interface{}) ([]byte, error) {
+	switch c := cred.(type) {
+	case AuthShort:
+		return c.Handle, nil
+	case *AuthShort:
+		return c.Handle, nil
+	default:
+		return nil, fmt.Errorf("invalid AUTH_SHORT credentials: %T", cred)
+	}
+}
+
+func (authShort) DecodeCred(body []byte) (interface{}, error) {
+	return AuthShort{Handle: body}, nil
+}
+
+func (authShort) Verifier(cred interface{}) (OpaqueAuth, error) {
+	return OpaqueAuth{Flavor: AuthFlavorNone}, nil
+}
+
+func (authShort) ValidateVerifier(cred interface{}, verf OpaqueAuth) error {
+	if verf.Flavor != AuthFlavorNone && verf.Flavor != AuthFlavorShort {
+		return errors.New("unexpected verifier for AUTH_SHORT")
+	}
+	return nil
+}
+
+// authShortCacheMaxEntries is the maximum number of AUTH_SHORT handles a server keeps at once.
+const authShortCacheMaxEntries = 4096
+
+// authShortCache holds the full credentials corresponding to the AUTH_SHORT handles issued
+// by a server. Entries expire when unused for ttl.
+//
+// A single handle is issued for each distinct identity, so that the cache doesn't grow with
+// clients that keep sending their full credentials (as most clients ignore AUTH_SHORT).
+// When the cache is full, the entry closest to expiration is evicted.
+type authShortCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu        sync.Mutex
+	entries   map[string]*authShortEntry // by handle
+	handles   map[string]string          // handles, by credentials (see authShortCredKey)
+	lastSweep time.Time
+}
+
+type authShortEntry struct {
+	cred    OpaqueAuth
+	expires time.Time
+}
+
+func newAuthShortCache(ttl time.Duration) *authShortCache {
+	return &authShortCache{
+		ttl:        ttl,
+		maxEntries: authShortCacheMaxEntries,
+		entries:    make(map[string]*authShortEntry),
+		handles:    make(map[string]string),
+		lastSweep:  time.Now(),
+	}
+}
+
+// authShortCredKey returns the key of the credentials in authShortCache.handles. AUTH_UNIX
+// credentials are keyed by identity, ignoring the stamp: many clients change it on each call.
+func authShortCredKey(cred OpaqueAuth) string {
+	if cred.Flavor == AuthFlavorUnix {
+		if c, err := (authUnix{}).DecodeCred(cred.Body); err == nil {
+			unix := c.(AuthUnix)
+			return fmt.Sprintf("%d:%q:%d:%d:%v", cred.Flavor, unix.MachineName, unix.Uid, unix.Gid, unix.Gids)
+		}
+	}
+	return fmt.Sprintf("%d:%s", cred.Flavor, cred.Body)
+}
+
+// issue returns a handle for the specified credentials, reusing the one already issued for
+// them (if any).
+func (c *authShortCache) issue(cred OpaqueAuth) ([]byte, error) {
+	now := time.Now()
+	key := authShortCredKey(cred)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if handle, found := c.handles[key]; found {
+		if e := c.entries[handle]; !now.After(e.expires) {
+			e.cred = cred
+			e.expires = now.Add(c.ttl)
+			return []byte(handle), nil
+		}
+		c.remove(handle)
+	}
+
+	// Periodically drop expired entries, so that the cache doesn't grow indefinitely with
+	// credentials of clients that went away.
+	if now.Sub(c.lastSweep) > c.ttl || len(c.entries) >= c.maxEntries {
+		for handle, e := range c.entries {
+			if now.After(e.expires) {
+				c.remove(handle)
+			}
+		}
+		c.lastSweep = now
+	}
+	if len(c.entries) >= c.maxEntries {
+		var oldest string
+		for handle, e := range c.entries {
+			if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+				oldest = handle
+			}
+		}
+		c.remove(oldest)
+	}
+
+	handle := make([]byte, authShortHandleSize)
+	if _, err := rand.Read(handle); err != nil {
+		return nil, err
+	}
+
+	c.entries[string(handle)] = &authShortEntry{cred: cred, expires: now.Add(c.ttl)}
+	c.handles[key] = string(handle)
+	return handle, nil
+}
+
+// remove drops the entry of a handle. c.mu must be held.
+func (c *authShortCache) remove(handle string) {
+	if e, found := c.entries[handle]; found {
+		delete(c.handles, authShortCredKey(e.cred))
+		delete(c.entries, handle)
+	}
+}
+
+// resolve returns the full credentials for a handle, if it is still valid.
+func (c *authShortCache) resolve(handle []byte) (OpaqueAuth, bool) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, found := c.entries[string(handle)]
+	if !found {
+		return OpaqueAuth{}, false
+	}
+	if now.After(e.expires) {
+		c.remove(string(handle))
+		return OpaqueAuth{}, false
+	}
+
+	e.expires = now.Add(c.ttl)
+	return e.cred, true
+}
@@ -0,0 +1,149 @@
+package sunrpc
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"time"
+
+	"github.com/rasky/go-xdr/xdr2"
+)
+
+// BroadcastReply is a reply to a call sent with PortmapperBroadcast.
+type BroadcastReply struct {
+	Addr   *net.UDPAddr // address of the portmapper which forwarded the call
+	Port   uint32       // port of the service on the replying host
+	Result []byte       // XDR-encoded reply of the service
+}
+
+// Decode decodes the reply of the service into reply.
+func (r *BroadcastReply) Decode(reply interface{}) error {
+	_, err := xdr.Unmarshal(bytes.NewReader(r.Result), reply)
+	return err
+}
+
+// PortmapperBroadcast calls a procedure on all the hosts reachable at addr (usually a broadcast
+// or multicast address, eg: "255.255.255.255:111"), through the PMAPPROC_CALLIT procedure of
+// their portmapper, over UDP. This is the equivalent of clnt_broadcast, and can be used to
+// discover the hosts of the LAN that run a service.
+//
+// The call is retransmitted as configured in cfg, and replies are collected until
+// cfg.RetransmitTotal elapses (or the ctx deadline, if earlier). Only the first successful reply
+// of each host is returned; failed calls are ignored, as the hosts are not expected to reply to
+// them. If ctx is cancelled, the replies collected so far are returned along with ctx.Err().
+func PortmapperBroadcast(ctx context.Context, addr string, program, version, proc uint32, args interface{}, cfg *ClientConfig) ([]BroadcastReply, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The client is only used to build the call and parse the replies, it never connects
+	c := NewClient(addr, PortmapperProgram, PortmapperVersion, cfg)
+
+	var encoded bytes.Buffer
+	if args != nil {
+		if _, err := xdr.Marshal(&encoded, args); err != nil {
+			return nil, err
+		}
+	}
+
+	pcall, err := c.newCall(PortmapperProgram, PortmapperVersion, PortmapperCallit)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := encodeCall(pcall, &pmapCallArgs{
+		Program:   program,
+		Version:   version,
+		Procedure: proc,
+		Args:      encoded.Bytes(),
+	}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Go enables SO_BROADCAST on UDP sockets by default
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Unblock the pending read as soon as the context is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	end := c.deadline(ctx, c.cfg.RetransmitTotal)
+	interval := c.cfg.RetransmitInitial
+	next := time.Now()
+
+	var replies []BroadcastReply
+	seen := make(map[string]bool)
+	buf := make([]byte, MaxUdpSize)
+
+	for {
+		now := time.Now()
+		if !now.Before(end) {
+			return replies, nil
+		}
+
+		if !now.Before(next) {
+			if _, err := conn.WriteTo(payload, raddr); err != nil {
+				return replies, broadcastErr(ctx, err)
+			}
+			next = now.Add(interval)
+			if interval *= 2; interval > c.cfg.RetransmitMax {
+				interval = c.cfg.RetransmitMax
+			}
+		}
+
+		readDeadline := next
+		if end.Before(readDeadline) {
+			readDeadline = end
+		}
+		conn.SetReadDeadline(readDeadline)
+
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() && contextErr(ctx) == nil {
+				continue
+			}
+			return replies, broadcastErr(ctx, err)
+		}
+
+		// Discard replies to other calls, failed calls, and duplicates caused by retransmissions
+		var res pmapCallResult
+		if err := c.readReply(bytes.NewReader(buf[:n]), pcall, &res); err != nil {
+			continue
+		}
+		if seen[from.String()] {
+			continue
+		}
+		seen[from.String()] = true
+
+		replies = append(replies, BroadcastReply{
+			Addr:   from.(*net.UDPAddr),
+			Port:   res.Port,
+			Result: res.Result,
+		})
+	}
+}
+
+// broadcastErr returns the error to report when a network operation fails during a broadcast:
+// reaching the deadline is the normal way to end the broadcast.
+func broadcastErr(ctx context.Context, err error) error {
+	switch ctxErr := contextErr(ctx); ctxErr {
+	case nil:
+		return err
+	case context.DeadlineExceeded:
+		return nil
+	default:
+		return ctxErr
+	}
+}
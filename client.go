@@ -2,8 +2,9 @@ package sunrpc
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 	"net"
 	"sync"
@@ -26,6 +27,28 @@ const (
 type ClientConfig struct {
 	Transport ClientTransport // transport to use (default: ClientTransportTcpUdp)
 	Timeout   time.Duration   // read/write timeout (default: 5 seconds)
+	Auth      ClientAuth      // credentials sent along with each call (default: AUTH_NONE)
+
+	// MaxMessageSize is the maximum size of a reply received over TCP (default: 32 KB); larger
+	// replies are discarded. Over UDP, replies are limited to ClientMaxRpcMessageSize.
+	MaxMessageSize int
+
+	// PortmapperClient is the portmapper that clients created with NewClientForHost query for
+	// the port of the service (default: the portmapper on port 111 of the host).
+	PortmapperClient *Portmapper
+
+	// Over UDP, a call is retransmitted (with the same Xid) if no reply is received within
+	// RetransmitInitial; the interval is doubled after each retransmission, up to RetransmitMax,
+	// until RetransmitTotal has elapsed and the call fails with ErrTimeout.
+	RetransmitInitial time.Duration // first retransmission interval (default: 500 milliseconds)
+	RetransmitMax     time.Duration // maximum retransmission interval (default: 4 seconds)
+	RetransmitTotal   time.Duration // total time to wait for a reply (default: Timeout)
+
+	// Pipelined allows many concurrent calls to be outstanding on the same connection. A
+	// background goroutine reads the replies and dispatches them to the waiting callers by Xid,
+	// so that the server is free to answer in any order. When false (default), concurrent
+	// calls are serialized.
+	Pipelined bool
 }
 
 type Client struct {
@@ -34,11 +57,28 @@ type Client struct {
 	Version uint32
 	cfg     ClientConfig
 
-	mu           sync.Mutex
+	// sem is a 1-slot semaphore guarding the connection state (see lock). When not pipelined,
+	// it is also held for the whole duration of a call, to serialize concurrent callers.
+	sem          chan struct{}
 	conn         net.Conn
 	disconnected bool
+	pipe         *pipeline // reply dispatcher for conn (pipelined mode only)
+
+	// connMu guards conn against Close, which closes it without waiting for the in-flight call
+	// (if any); closed records that it did, so that the client reconnects on the next call.
+	connMu sync.Mutex
+	closed bool
+
+	host      string      // set by NewClientForHost, the address is resolved through pmap
+	pmap      *Portmapper // portmapper used to resolve the address of host
+	ownPmap   bool        // whether pmap was created by the client, and must be closed with it
+	connected bool        // whether a connection was ever established
 }
 
+// aLongTimeAgo is a non-zero time, far in the past, used to immediately unblock pending network
+// operations when a call is cancelled.
+var aLongTimeAgo = time.Unix(1, 0)
+
 var clientBufPool = sync.Pool{
 	New: func() interface{} {
 		data := make([]byte, ClientMaxRpcMessageSize)
@@ -60,20 +100,57 @@ func NewClient(addr string, program, version uint32, cfg *ClientConfig) *Client
 	if cfg.Timeout == zz {
 		cfg.Timeout = 5 * time.Second
 	}
+	if cfg.RetransmitInitial == zz {
+		cfg.RetransmitInitial = 500 * time.Millisecond
+	}
+	if cfg.RetransmitMax == zz {
+		cfg.RetransmitMax = 4 * time.Second
+	}
+	if cfg.RetransmitTotal == zz {
+		cfg.RetransmitTotal = cfg.Timeout
+	}
+	if cfg.MaxMessageSize == 0 {
+		cfg.MaxMessageSize = ClientMaxRpcMessageSize
+	}
 
 	return &Client{
 		Addr:         addr,
 		Program:      program,
 		Version:      version,
 		cfg:          *cfg,
+		sem:          make(chan struct{}, 1),
 		disconnected: true,
 	}
 }
 
+// lock acquires the client semaphore, unless ctx is done first. Unlike a mutex, this allows
+// callers queued behind an in-flight call to give up.
+func (c *Client) lock(ctx context.Context) error {
+	select {
+	case c.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) unlock() {
+	<-c.sem
+}
+
+// Close closes the connection to the server. Calls in progress are aborted, and fail with a
+// closed connection error; following calls reconnect to the server.
 func (c *Client) Close() {
-	c.mu.Lock()
-	c.close()
-	c.mu.Unlock()
+	c.connMu.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.closed = true
+	}
+	c.connMu.Unlock()
+
+	if c.ownPmap {
+		c.pmap.Close()
+	}
 }
 
 // Call the specified proc in the RPC server, optionally passing some args, and receive
@@ -82,103 +159,319 @@ func (c *Client) Close() {
 // On top of network errors, err can be one of the errors defined in this package to signal
 // specific error conditions that callers might want to specifically handle.
 func (c *Client) Call(proc uint32, args, reply interface{}) (err error) {
-	return c.CallProgram(c.Program, c.Version, proc, args, reply)
+	return c.CallProgramContext(context.Background(), c.Program, c.Version, proc, args, reply)
 }
 
 // CallProgram is like Call, but allows to define a non-default program and version.
 func (c *Client) CallProgram(program, version uint32, proc uint32, args, reply interface{}) error {
-	if c.disconnected {
-		if err := c.reconnect(); err != nil {
+	return c.CallProgramContext(context.Background(), program, version, proc, args, reply)
+}
+
+// CallContext is like Call, but the call is bound to the specified context. If the context
+// has a deadline earlier than the configured timeout, it is used as read/write deadline; if the
+// context is cancelled while the call is in progress, the call is aborted and ctx.Err() is returned.
+func (c *Client) CallContext(ctx context.Context, proc uint32, args, reply interface{}) error {
+	return c.CallProgramContext(ctx, c.Program, c.Version, proc, args, reply)
+}
+
+// CallProgramContext is like CallContext, but allows to define a non-default program and version.
+//
+// When a call is aborted because of the context, the client is marked as disconnected (as we
+// can't know how much of the call went through) and will reconnect on the next call. In pipelined
+// mode, only the aborted call is affected and the connection is left alone.
+func (c *Client) CallProgramContext(ctx context.Context, program, version uint32, proc uint32, args, reply interface{}) error {
+	err := c.callProgram(ctx, program, version, proc, args, reply)
+	if c.refreshAuth(err) {
+		// The credentials were refreshed, try again
+		err = c.callProgram(ctx, program, version, proc, args, reply)
+	}
+	return err
+}
+
+// refreshAuth checks whether err is an authentication error that might be solved by refreshing
+// the client credentials, and does so.
+func (c *Client) refreshAuth(err error) bool {
+	autherr, ok := err.(*ErrAuth)
+	if !ok {
+		return false
+	}
+	refresher, ok := c.cfg.Auth.(ClientAuthRefresher)
+	return ok && refresher.Refresh(autherr.Stat)
+}
+
+func (c *Client) callProgram(ctx context.Context, program, version uint32, proc uint32, args, reply interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := c.lock(ctx); err != nil {
+		return err
+	}
+	c.connMu.Lock()
+	closed := c.closed
+	c.connMu.Unlock()
+	if c.disconnected || closed {
+		if err := c.reconnect(ctx); err != nil {
+			c.unlock()
 			return err
 		}
 		if proc == 0 {
 			// we already executed a ping during reconnection, so don't send a second one
+			c.unlock()
 			return nil
 		}
 	}
 
-	var useUdp bool
-	var buf bytes.Buffer
+	if c.cfg.Pipelined {
+		pipe := c.pipe
+		c.unlock()
+		return c.callPipelined(ctx, pipe, program, version, proc, args, reply)
+	}
 
-	_, useUdp = c.conn.(*net.UDPConn)
+	defer c.unlock()
+	return c.callSync(ctx, program, version, proc, args, reply)
+}
 
-	pcall := NewProcedureCall(program, version, proc)
-	if _, err := xdr.Marshal(&buf, pcall); err != nil {
-		return err
+// deadline returns the deadline for the next network operation, that is the earliest between
+// the specified timeout and the context deadline (if any). A zero time means no deadline.
+func (c *Client) deadline(ctx context.Context, timeout time.Duration) time.Time {
+	var deadline time.Time
+	if timeout != 0 {
+		deadline = time.Now().Add(timeout)
 	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	return deadline
+}
 
-	// Write procedure arguments to the buffer (if any)
-	if args != nil {
-		if _, err := xdr.Marshal(&buf, args); err != nil {
-			return err
+// callSync performs a call on the current connection, and waits for its reply. The client
+// must be locked.
+func (c *Client) callSync(ctx context.Context, program, version uint32, proc uint32, args, reply interface{}) error {
+	conn := c.conn
+
+	// Unblock any pending read or write as soon as the context is cancelled. We wait for
+	// the watcher to exit before returning, so that it can't touch the deadlines of
+	// a subsequent call.
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		exited := make(chan struct{})
+		go func() {
+			defer close(exited)
+			select {
+			case <-ctx.Done():
+				conn.SetDeadline(aLongTimeAgo)
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-exited
+		}()
+	}
+
+	err := c.roundTrip(ctx, conn, program, version, proc, args, reply)
+	if err != nil {
+		if ctxErr := contextErr(ctx); ctxErr != nil {
+			c.disconnected = true
+			return ctxErr
 		}
 	}
+	return err
+}
 
-	// Set write timeout to avoid stalling forever
-	var zd time.Duration
-	if c.cfg.Timeout != zd {
-		c.conn.SetWriteDeadline(time.Now().Add(c.cfg.Timeout))
+// contextErr is like ctx.Err(), but also reports an expired deadline that the context itself
+// has not noticed yet, as network deadlines derived from it might fire slightly earlier.
+func contextErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return context.DeadlineExceeded
 	}
+	return nil
+}
 
-	// On TCP transport, we need to write a record marker
-	if !useUdp {
-		// Because of a bug on the Linux implementation of rpcbind, we want
-		// to send the record marker and the payload in a single TCP segment
-		// if possible (so with a single conn.Write)
-		full := bytes.NewBuffer(make([]byte, 0, buf.Len()+4))
-		if err := WriteRecordMarker(full, uint32(buf.Len()), true); err != nil {
-			return err
+func (c *Client) roundTrip(ctx context.Context, conn net.Conn, program, version uint32, proc uint32, args, reply interface{}) error {
+	_, useUdp := conn.(*net.UDPConn)
+
+	pcall, err := c.newCall(program, version, proc)
+	if err != nil {
+		return err
+	}
+
+	payload, err := encodeCall(pcall, args, useUdp)
+	if err != nil {
+		return err
+	}
+
+	if useUdp {
+		return c.roundTripUdp(ctx, conn, pcall, payload, reply)
+	}
+
+	// Set write deadline to avoid stalling forever. We always set it (even if zero)
+	// to reset a deadline left behind by a previous cancelled call.
+	conn.SetWriteDeadline(c.deadline(ctx, c.cfg.Timeout))
+
+	// Send the payload
+	if _, err := conn.Write(payload); err != nil {
+		c.disconnected = true
+		return err
+	}
+
+	conn.SetReadDeadline(c.deadline(ctx, c.cfg.Timeout))
+
+	// On TCP transport, we need to read the record through different markers. The reply is
+	// decoded while it is received.
+	rr := NewRecordReader(conn, c.cfg.MaxMessageSize)
+	if err := rr.Next(); err != nil {
+		c.disconnected = true
+		return err
+	}
+
+	err = c.readReply(rr, pcall, reply)
+
+	// Skip what is left of the record (eg: if the reply was not decoded), so that the
+	// connection can be used for the next call.
+	if derr := rr.Discard(); derr != nil || err == errInvalidReply {
+		c.disconnected = true
+		if err == nil {
+			err = derr
 		}
-		io.Copy(full, &buf)
+	}
+	return err
+}
 
-		// Send the payload
-		if _, err := c.conn.Write(full.Bytes()); err != nil {
-			c.disconnected = true
+// roundTripUdp sends a call over UDP and waits for its reply, retransmitting the call with
+// exponential backoff. Replies with a different Xid (eg: late replies to previous calls,
+// or duplicates caused by retransmissions) are discarded.
+func (c *Client) roundTripUdp(ctx context.Context, conn net.Conn, pcall *ProcedureCall, payload []byte, reply interface{}) error {
+	xid := pcall.Header.Xid
+	deadline := c.deadline(ctx, c.cfg.RetransmitTotal)
+	interval := c.cfg.RetransmitInitial
+
+	// We need to read the whole answer through a single Read() call because it is a
+	// single datagram. Use a pool of buffers to speed up processing
+	buf := clientBufPool.Get().(*[]byte)
+	defer clientBufPool.Put(buf)
+
+	for {
+		// Setting the deadlines overrides the one set by the cancellation watcher in callSync,
+		// so check the context afterwards: if it is cancelled now, the watcher has already run.
+		retransmit := time.Now().Add(interval)
+		if !deadline.IsZero() && retransmit.After(deadline) {
+			retransmit = deadline
+		}
+		conn.SetWriteDeadline(deadline)
+		conn.SetReadDeadline(retransmit)
+		if err := contextErr(ctx); err != nil {
 			return err
 		}
-	} else {
-		// Send the payload
-		if _, err := c.conn.Write(buf.Bytes()); err != nil {
+
+		if _, err := conn.Write(payload); err != nil {
 			c.disconnected = true
 			return err
 		}
+
+		for {
+			// Read the reply header. We want this to happen in a pure network
+			// read so that we can detect whether the server is actually replying
+			// or there is a network error (specifically important in case of UDP:
+			// in fact, in that case, this is where we get an error if the UDP port
+			// was closed while sending).
+			n, err := conn.Read(*buf)
+			if err != nil {
+				if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+					if err := contextErr(ctx); err != nil {
+						return err
+					}
+					if !deadline.IsZero() && !time.Now().Before(deadline) {
+						return &ErrTimeout{}
+					}
+					break
+				}
+				c.disconnected = true
+				return err
+			}
+
+			if n < 4 || binary.BigEndian.Uint32(*buf) != xid {
+				log.WithField("xid", xid).Debug("discarding stale RPC reply")
+				continue
+			}
+
+			return c.readReply(bytes.NewReader((*buf)[:n]), pcall, reply)
+		}
+
+		if interval *= 2; interval > c.cfg.RetransmitMax {
+			interval = c.cfg.RetransmitMax
+		}
 	}
+}
 
-	// Read the reply header. We want this to happen in a pure network
-	// read so that we can detect whether the server is actually replying
-	// or there is a network error (specifically important in case of UDP:
-	// in fact, in that case, this is where we get an error if the UDP port
-	// was closed while sending).
-	var replyh ProcedureReply
+// newCall creates the header of a new call, carrying the client credentials (if any).
+func (c *Client) newCall(program, version uint32, proc uint32) (*ProcedureCall, error) {
+	pcall := NewProcedureCall(program, version, proc)
 
-	if c.cfg.Timeout != zd {
-		c.conn.SetReadDeadline(time.Now().Add(c.cfg.Timeout))
+	if c.cfg.Auth != nil {
+		cred, verf, err := c.cfg.Auth.Auth()
+		if err != nil {
+			return nil, err
+		}
+		pcall.Body.Cred = cred
+		pcall.Body.Verf = verf
 	}
 
-	var reader io.Reader
+	return pcall, nil
+}
+
+// rawXDR holds arguments or results that are already XDR-encoded. When passed as arguments, they
+// are sent as-is; when passed as reply, it receives the whole undecoded reply body.
+type rawXDR []byte
 
-	if _, ok := c.conn.(*net.UDPConn); !ok {
-		// On TCP transport, we need to read the record through different markers
-		if buf, err := ReadRecord(c.conn); err != nil {
-			c.disconnected = true
-			return err
-		} else {
-			reader = buf
+// errInvalidReply is returned by readReply when the reply cannot be parsed at all; when this
+// happens on a stream transport, the connection is no longer usable.
+var errInvalidReply = errors.New("RPC reply has invalid wire format")
+
+// encodeCall serializes a call header and its arguments (if any). On TCP, the payload is
+// prefixed with the record marker.
+func encodeCall(pcall *ProcedureCall, args interface{}, udp bool) ([]byte, error) {
+	var buf bytes.Buffer
+
+	// On TCP transport, we need to write a record marker. Because of a bug on the Linux
+	// implementation of rpcbind, we want to send the record marker and the payload in a
+	// single TCP segment if possible (so with a single conn.Write), so reserve space for it
+	// and patch it once the size is known.
+	if !udp {
+		buf.Write(make([]byte, 4))
+	}
+
+	if _, err := xdr.Marshal(&buf, pcall); err != nil {
+		return nil, err
+	}
+
+	// Write procedure arguments to the buffer (if any)
+	if raw, ok := args.(rawXDR); ok {
+		buf.Write(raw)
+	} else if args != nil {
+		if _, err := xdr.Marshal(&buf, args); err != nil {
+			return nil, err
 		}
-	} else {
-		// On UDP, we need to read the whole answer through a single Read()
-		// call because it is a single datagram. Use a pool of buffers
-		// to speed up processing
-		buf := clientBufPool.Get().(*[]byte)
-		defer clientBufPool.Put(buf)
-
-		if n, err := c.conn.Read(*buf); err != nil {
-			c.disconnected = true
-			return err
-		} else {
-			reader = bytes.NewReader((*buf)[:n])
+	}
+
+	payload := buf.Bytes()
+	if !udp {
+		if len(payload)-4 > MaxFragmentSize {
+			// Large calls must be split in multiple fragments
+			return appendRecord(nil, payload[4:]), nil
 		}
+		binary.BigEndian.PutUint32(payload, NewRecordMarker(uint32(len(payload)-4), true))
 	}
+	return payload, nil
+}
+
+// readReply parses the reply message to pcall, and decodes the reply body (if any) into reply.
+func (c *Client) readReply(reader io.Reader, pcall *ProcedureCall, reply interface{}) error {
+	var replyh ProcedureReply
 
 	if _, err := xdr.Unmarshal(reader, &replyh); err != nil {
 		return err
@@ -188,7 +481,7 @@ func (c *Client) CallProgram(program, version uint32, proc uint32, args, reply i
 		return errors.New("invalid Xid in reply")
 	}
 
-	if replyh.Header.Type != Reply {
+	if replyh.Header.Type != ReplyMessage {
 		return errors.New("invalid reply type")
 	}
 
@@ -199,8 +492,7 @@ func (c *Client) CallProgram(program, version uint32, proc uint32, args, reply i
 		case AuthError:
 			return &ErrAuth{Stat: replyh.Rejected.AuthStat}
 		default:
-			c.disconnected = true
-			return fmt.Errorf("RPC reply has invalid wire format")
+			return errInvalidReply
 		}
 	}
 
@@ -214,11 +506,27 @@ func (c *Client) CallProgram(program, version uint32, proc uint32, args, reply i
 			return &ErrProgUnavail{}
 		case GarbageArgs:
 			return &ErrGarbageArgs{}
+		case SystemErr:
+			return &ErrSystem{}
+		default:
+			return &RPCStatusError{Type: Accepted, Accept: replyh.Accepted.Stat}
+		}
+	}
+
+	if v, ok := c.cfg.Auth.(ClientAuthValidator); ok {
+		if err := v.ValidateVerifier(pcall.Body.Cred, replyh.Accepted.Verf); err != nil {
+			return err
 		}
 	}
 
 	// Everything is OK, read reply body (if any)
-	if reply != nil {
+	if raw, ok := reply.(*rawXDR); ok {
+		body, err := io.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		*raw = body
+	} else if reply != nil {
 		if _, err := xdr.Unmarshal(reader, reply); err != nil {
 			return err
 		}
@@ -228,17 +536,20 @@ func (c *Client) CallProgram(program, version uint32, proc uint32, args, reply i
 }
 
 func (c *Client) close() {
+	c.connMu.Lock()
 	if c.conn != nil {
 		c.conn.Close()
 		c.conn = nil
 	}
+	c.closed = false
+	c.connMu.Unlock()
+	c.pipe = nil
 	c.disconnected = true
 }
 
-func (c *Client) reconnect() error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
+// reconnect closes the current connection (if any) and establishes a new one, checking that
+// the server answers to pings. The client must be locked.
+func (c *Client) reconnect(ctx context.Context) error {
 	c.close()
 
 	var prot []string
@@ -253,19 +564,47 @@ func (c *Client) reconnect() error {
 		prot = []string{"tcp"}
 	}
 
+	dialer := net.Dialer{Timeout: c.cfg.Timeout}
 	for _, p := range prot {
-		conn, err := net.Dial(p, c.Addr)
+		// A cached address is only trusted for the first connection: reconnections follow
+		// failures, which may be caused by the service having moved to a different port.
+		addr, err := c.resolveAddr(ctx, p, !c.connected)
+		if err != nil {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		conn, err := dialer.DialContext(ctx, p, addr)
 		if err == nil {
+			c.connMu.Lock()
 			c.conn = conn
+			c.connMu.Unlock()
 			c.disconnected = false
 			// Check with procedure 0, which is always reserved as a ping
-			if c.Call(0, nil, nil) == nil {
+			err := c.callSync(ctx, c.Program, c.Version, 0, nil, nil)
+			if c.refreshAuth(err) {
+				err = c.callSync(ctx, c.Program, c.Version, 0, nil, nil)
+			}
+			if err == nil {
+				if c.cfg.Pipelined {
+					c.pipe = newPipeline(c, conn)
+				}
+				c.Addr = addr
+				c.connected = true
 				return nil
 			}
+			c.connMu.Lock()
 			c.conn = nil
+			c.connMu.Unlock()
 			c.disconnected = true
 			conn.Close()
 		}
+		c.forgetAddr(p)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 	}
 
 	return errors.New("cannot connect to RPC server")
@@ -2,15 +2,23 @@ package sunrpc
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/rasky/go-xdr/xdr2"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestWriteCall(t *testing.T) {
 	var buf bytes.Buffer
 
-	err := WriteCall(&buf, PortmapperProgram, PortmapperVersion, PortmapperPortSet, mapping{
+	err := WriteCall(&buf, PortmapperProgram, PortmapperVersion, PortmapperPortSet, pmapMapping{
 		Program:  1,
 		Version:  1,
 		Protocol: Tcp,
@@ -30,3 +38,424 @@ func TestWriteCall(t *testing.T) {
 	assert.Equal(t, expected[0:4], buf.Bytes()[0:4]) // Test marker
 	assert.Equal(t, expected[8:], buf.Bytes()[8:])   // Then the rest of the payload, excluding the transaction id
 }
+
+// startFakeServer starts a TCP server on a random local port, passing every incoming call
+// to handler. The handler returns the reply to send back, or false to never answer.
+func startFakeServer(t *testing.T, handler func(call *ProcedureCall, body io.Reader) ([]byte, bool)) string {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					record, err := ReadRecord(conn)
+					if err != nil {
+						return
+					}
+					call, err := ReadProcedureCall(record)
+					if err != nil {
+						return
+					}
+					if reply, ok := handler(call, record); ok {
+						if err := WriteTCPReplyMessage(conn, reply); err != nil {
+							return
+						}
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func fakeReply(t *testing.T, call *ProcedureCall, ret interface{}) []byte {
+	var buf bytes.Buffer
+	var s server
+	if err := s.WriteReplyMessage(&buf, call.Header.Xid, Success, ret); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCallContextCancel(t *testing.T) {
+	addr := startFakeServer(t, func(call *ProcedureCall, body io.Reader) ([]byte, bool) {
+		if call.Body.Procedure == 1 {
+			// Never reply to proc #1
+			return nil, false
+		}
+		return fakeReply(t, call, nil), true
+	})
+
+	client := NewClient(addr, 1, 1, &ClientConfig{Transport: ClientTransportTcpOnly})
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err := client.CallContext(ctx, 1, nil, nil)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.True(t, client.disconnected)
+
+	// The client reconnects on the next call
+	assert.Nil(t, client.Call(2, nil, nil))
+
+	// Over UDP, the call is cancelled even while it is being retransmitted
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, MaxUdpSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			call, err := ReadProcedureCall(bytes.NewReader(buf[:n]))
+			if err == nil && call.Body.Procedure == 0 {
+				conn.WriteTo(fakeReply(t, call, nil), addr)
+			}
+		}
+	}()
+
+	client = NewClient(conn.LocalAddr().String(), 1, 1, &ClientConfig{
+		Transport:         ClientTransportUdpOnly,
+		RetransmitInitial: 20 * time.Millisecond,
+		RetransmitTotal:   3 * time.Second,
+	})
+	defer client.Close()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start = time.Now()
+	err = client.CallContext(ctx, 1, nil, nil)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestCallContextQueued(t *testing.T) {
+	addr := startFakeServer(t, func(call *ProcedureCall, body io.Reader) ([]byte, bool) {
+		if call.Body.Procedure == 1 {
+			return nil, false
+		}
+		return fakeReply(t, call, nil), true
+	})
+
+	client := NewClient(addr, 1, 1, &ClientConfig{Transport: ClientTransportTcpOnly, Timeout: 5 * time.Second})
+	defer client.Close()
+	assert.Nil(t, client.Call(0, nil, nil))
+
+	// A call waiting for the in-flight one to complete gives up when its context is cancelled
+	inflight, cancelInflight := context.WithCancel(context.Background())
+	defer cancelInflight()
+	go client.CallContext(inflight, 1, nil, nil)
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, client.CallContext(ctx, 2, nil, nil))
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestCloseDuringCall(t *testing.T) {
+	release := make(chan struct{}, 1)
+	slow := func(arg struct{}, reply *struct{}) error {
+		<-release
+		return nil
+	}
+
+	tsrv := NewTCPServer(1, 1).(*TCPServer)
+	tsrv.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	tsrv.Register(1, slow)
+	usrv := NewUDPServer(1, 1).(*UDPServer)
+	usrv.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	usrv.Register(1, slow)
+
+	for _, test := range []struct {
+		addr      string
+		transport ClientTransport
+	}{
+		{serveTCP(t, tsrv), ClientTransportTcpOnly},
+		{serveUDP(t, usrv), ClientTransportUdpOnly},
+	} {
+		client := NewClient(test.addr, 1, 1, &ClientConfig{Transport: test.transport, Timeout: 5 * time.Second})
+		assert.Nil(t, client.Call(0, nil, nil))
+
+		// Close doesn't wait for the slow call: it aborts it
+		callErr := make(chan error, 1)
+		go func() { callErr <- client.Call(1, nil, nil) }()
+		time.Sleep(20 * time.Millisecond)
+
+		start := time.Now()
+		client.Close()
+		assert.True(t, time.Since(start) < time.Second)
+		select {
+		case err := <-callErr:
+			assert.True(t, errors.Is(err, net.ErrClosed), "%v", err)
+		case <-time.After(time.Second):
+			t.Fatal("call not aborted by Close")
+		}
+
+		// The client reconnects on the next call
+		release <- struct{}{}
+		assert.Nil(t, client.Call(0, nil, nil))
+		client.Close()
+	}
+}
+
+func TestCallContextDeadline(t *testing.T) {
+	addr := startFakeServer(t, func(call *ProcedureCall, body io.Reader) ([]byte, bool) {
+		if call.Body.Procedure == 1 {
+			return nil, false
+		}
+		var arg uint32
+		xdr.Unmarshal(body, &arg)
+		return fakeReply(t, call, arg+1), true
+	})
+
+	client := NewClient(addr, 1, 1, &ClientConfig{Transport: ClientTransportTcpOnly})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := client.CallContext(ctx, 1, nil, nil)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	var reply uint32
+	assert.Nil(t, client.CallContext(context.Background(), 2, uint32(41), &reply))
+	assert.EqualValues(t, 42, reply)
+}
+
+func TestPipelinedCalls(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// The server answers to each call after a delay inversely proportional to its argument,
+	// so replies are sent in a different order than calls.
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var wmu sync.Mutex
+				for {
+					record, err := ReadRecord(conn)
+					if err != nil {
+						return
+					}
+					call, err := ReadProcedureCall(record)
+					if err != nil {
+						return
+					}
+					var arg uint32
+					xdr.Unmarshal(record, &arg)
+					go func() {
+						time.Sleep(time.Duration(20-arg) * 5 * time.Millisecond)
+						wmu.Lock()
+						defer wmu.Unlock()
+						WriteTCPReplyMessage(conn, fakeReply(t, call, arg*2))
+					}()
+				}
+			}()
+		}
+	}()
+
+	client := NewClient(listener.Addr().String(), 1, 1, &ClientConfig{
+		Transport: ClientTransportTcpOnly,
+		Pipelined: true,
+	})
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := uint32(1); i < 20; i++ {
+		wg.Add(1)
+		go func(i uint32) {
+			defer wg.Done()
+			var reply uint32
+			assert.Nil(t, client.Call(1, i, &reply))
+			assert.Equal(t, i*2, reply)
+		}(i)
+	}
+	wg.Wait()
+
+	// Calls were concurrent, so the total time is roughly the one of the slowest call
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+
+	// A call timing out does not affect the connection
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, client.CallContext(ctx, 1, uint32(1), nil))
+
+	var reply uint32
+	assert.Nil(t, client.Call(1, uint32(19), &reply))
+	assert.EqualValues(t, 38, reply)
+	assert.False(t, client.disconnected)
+}
+
+func TestUdpRetransmission(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The server ignores the first two transmissions of each call, and answers the third one
+	// after sending a stale reply with a different Xid.
+	var mu sync.Mutex
+	received := make(map[uint32]int)
+	go func() {
+		buf := make([]byte, MaxUdpSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			call, err := ReadProcedureCall(bytes.NewReader(buf[:n]))
+			if err != nil {
+				continue
+			}
+			mu.Lock()
+			received[call.Header.Xid]++
+			count := received[call.Header.Xid]
+			mu.Unlock()
+
+			if call.Body.Procedure == 0 || count == 3 {
+				stale := *call
+				stale.Header.Xid++
+				conn.WriteTo(fakeReply(t, &stale, uint32(0)), addr)
+				conn.WriteTo(fakeReply(t, call, uint32(42)), addr)
+			}
+		}
+	}()
+
+	client := NewClient(conn.LocalAddr().String(), 1, 1, &ClientConfig{
+		Transport:         ClientTransportUdpOnly,
+		RetransmitInitial: 20 * time.Millisecond,
+		RetransmitMax:     40 * time.Millisecond,
+		RetransmitTotal:   time.Second,
+	})
+	defer client.Close()
+
+	var reply uint32
+	assert.Nil(t, client.Call(1, nil, &reply))
+	assert.EqualValues(t, 42, reply)
+
+	// All the transmissions of the call had the same Xid
+	mu.Lock()
+	counts := make(map[int]int)
+	for _, count := range received {
+		counts[count]++
+	}
+	mu.Unlock()
+	assert.Equal(t, 1, counts[3])
+}
+
+func TestUdpTimeout(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The server only answers pings
+	go func() {
+		buf := make([]byte, MaxUdpSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			call, err := ReadProcedureCall(bytes.NewReader(buf[:n]))
+			if err == nil && call.Body.Procedure == 0 {
+				conn.WriteTo(fakeReply(t, call, nil), addr)
+			}
+		}
+	}()
+
+	for _, pipelined := range []bool{false, true} {
+		client := NewClient(conn.LocalAddr().String(), 1, 1, &ClientConfig{
+			Transport:         ClientTransportUdpOnly,
+			RetransmitInitial: 10 * time.Millisecond,
+			RetransmitTotal:   100 * time.Millisecond,
+			Pipelined:         pipelined,
+		})
+
+		err := client.Call(1, nil, nil)
+		assert.IsType(t, &ErrTimeout{}, err)
+		client.Close()
+	}
+}
+
+func TestNewClientForHost(t *testing.T) {
+	p := startPortmapperServer(t)
+	pmap := NewPortmapper(p.Addr().String(), nil)
+	defer pmap.Close()
+
+	start := func() (*TCPServer, uint32) {
+		srv := NewTCPServer(1234, 1).(*TCPServer)
+		srv.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+		srv.Register(1, func(arg uint32, reply *uint32) error {
+			*reply = arg + 1
+			return nil
+		})
+		serveTCP(t, srv)
+		port := uint32(srv.Addr().(*net.TCPAddr).Port)
+
+		pmap.Unset(1234, 1)
+		assert.Nil(t, pmap.Set(1234, 1, Tcp, port))
+		return srv, port
+	}
+
+	srv, port := start()
+
+	cfg := &ClientConfig{Transport: ClientTransportTcpOnly, PortmapperClient: pmap}
+	client := NewClientForHost("127.0.0.1", 1234, 1, cfg)
+	defer client.Close()
+
+	var reply uint32
+	assert.Nil(t, client.Call(1, uint32(1), &reply))
+	assert.Equal(t, uint32(2), reply)
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", port), client.Addr)
+
+	// Restart the service on a different port: the client resolves it again
+	srv.Close()
+	assert.NotNil(t, client.Call(1, uint32(1), &reply))
+
+	srv, port = start()
+	assert.Nil(t, client.Call(1, uint32(2), &reply))
+	assert.Equal(t, uint32(3), reply)
+	assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", port), client.Addr)
+
+	// Unregistered services cannot be reached
+	other := NewClientForHost("127.0.0.1", 4321, 1, cfg)
+	defer other.Close()
+	assert.NotNil(t, other.Call(0, nil, nil))
+}
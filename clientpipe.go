@@ -0,0 +1,216 @@
+package sunrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// pipeline dispatches the replies received on a connection to the concurrent callers waiting
+// for them, matching them by Xid.
+type pipeline struct {
+	client *Client
+	conn   net.Conn
+	udp    bool
+
+	wmu sync.Mutex // serializes writes of whole records
+
+	mu      sync.Mutex
+	pending map[uint32]chan []byte
+	err     error // set when the reader exits, no new call is accepted afterwards
+}
+
+// newPipeline creates a pipeline over conn, and starts its reader goroutine.
+func newPipeline(c *Client, conn net.Conn) *pipeline {
+	_, udp := conn.(*net.UDPConn)
+
+	p := &pipeline{
+		client:  c,
+		conn:    conn,
+		udp:     udp,
+		pending: make(map[uint32]chan []byte),
+	}
+
+	// The reader waits for replies indefinitely, timeouts are handled by each caller.
+	conn.SetReadDeadline(time.Time{})
+	go p.readLoop()
+
+	return p
+}
+
+// register allocates the channel where the reply to the call with the specified Xid is delivered.
+func (p *pipeline) register(xid uint32) (chan []byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	ch := make(chan []byte, 1)
+	p.pending[xid] = ch
+	return ch, nil
+}
+
+// unregister forgets about a call; a reply for it, if ever received, is dropped.
+func (p *pipeline) unregister(xid uint32) {
+	p.mu.Lock()
+	delete(p.pending, xid)
+	p.mu.Unlock()
+}
+
+// write sends a whole record (or datagram) on the connection.
+func (p *pipeline) write(payload []byte, deadline time.Time) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+
+	p.conn.SetWriteDeadline(deadline)
+	if _, err := p.conn.Write(payload); err != nil {
+		// A partial write would corrupt the stream; close the connection, the reader will
+		// then fail all pending calls and mark the client as disconnected.
+		p.conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (p *pipeline) readLoop() {
+	for {
+		var record []byte
+
+		if p.udp {
+			buf := make([]byte, ClientMaxRpcMessageSize)
+			n, err := p.conn.Read(buf)
+			if err != nil {
+				p.fail(err)
+				return
+			}
+			record = buf[:n]
+		} else {
+			buf, err := ReadRecordLimit(p.conn, p.client.cfg.MaxMessageSize)
+			if err != nil {
+				p.fail(err)
+				return
+			}
+			record = buf.Bytes()
+		}
+
+		if len(record) < 4 {
+			log.Warn("dropping truncated RPC reply")
+			continue
+		}
+
+		xid := binary.BigEndian.Uint32(record)
+
+		p.mu.Lock()
+		ch, found := p.pending[xid]
+		delete(p.pending, xid)
+		p.mu.Unlock()
+
+		if !found {
+			log.WithField("xid", xid).Debug("dropping RPC reply with unknown Xid")
+			continue
+		}
+		ch <- record
+	}
+}
+
+// fail is called when the connection is no longer usable: it wakes up all waiting callers
+// and marks the client as disconnected.
+func (p *pipeline) fail(err error) {
+	p.mu.Lock()
+	p.err = err
+	for xid, ch := range p.pending {
+		close(ch)
+		delete(p.pending, xid)
+	}
+	p.mu.Unlock()
+
+	c := p.client
+	c.lock(context.Background())
+	if c.pipe == p {
+		c.close()
+	}
+	c.unlock()
+}
+
+// callPipelined performs a call on the pipeline, and waits for its reply.
+func (c *Client) callPipelined(ctx context.Context, p *pipeline, program, version uint32, proc uint32, args, reply interface{}) error {
+	pcall, err := c.newCall(program, version, proc)
+	if err != nil {
+		return err
+	}
+
+	payload, err := encodeCall(pcall, args, p.udp)
+	if err != nil {
+		return err
+	}
+
+	xid := pcall.Header.Xid
+	ch, err := p.register(xid)
+	if err != nil {
+		return err
+	}
+
+	total := c.cfg.Timeout
+	if p.udp {
+		total = c.cfg.RetransmitTotal
+	}
+	deadline := c.deadline(ctx, total)
+
+	if err := p.write(payload, deadline); err != nil {
+		p.unregister(xid)
+		return err
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// Over UDP, retransmit the call with exponential backoff until a reply arrives
+	var retransmit *time.Timer
+	var retransmitC <-chan time.Time
+	interval := c.cfg.RetransmitInitial
+	if p.udp {
+		retransmit = time.NewTimer(interval)
+		defer retransmit.Stop()
+		retransmitC = retransmit.C
+	}
+
+	for {
+		select {
+		case record, ok := <-ch:
+			if !ok {
+				// The connection failed while waiting
+				p.mu.Lock()
+				defer p.mu.Unlock()
+				return p.err
+			}
+			return c.readReply(bytes.NewReader(record), pcall, reply)
+		case <-retransmitC:
+			if err := p.write(payload, deadline); err != nil {
+				p.unregister(xid)
+				return err
+			}
+			if interval *= 2; interval > c.cfg.RetransmitMax {
+				interval = c.cfg.RetransmitMax
+			}
+			retransmit.Reset(interval)
+		case <-timeout:
+			p.unregister(xid)
+			if err := contextErr(ctx); err != nil {
+				return err
+			}
+			return &ErrTimeout{}
+		case <-ctx.Done():
+			p.unregister(xid)
+			return ctx.Err()
+		}
+	}
+}
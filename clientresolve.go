@@ -0,0 +1,135 @@
+package sunrpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// NewClientForHost creates a new RPC client for a program/version service running on the
+// specified host, whose port is looked up in the portmapper (rpcbind) of the host itself (or
+// in cfg.PortmapperClient, if set), separately for each transport allowed by cfg.
+//
+// Like NewClient, this function does not attempt any connection. The result of the lookup is
+// cached and shared among clients; after a connection failure, the client queries the
+// portmapper again, in case the service was restarted on a different port. Addr reports
+// the address of the last successful connection.
+func NewClientForHost(host string, program, version uint32, cfg *ClientConfig) *Client {
+	c := NewClient(host, program, version, cfg)
+	c.host = host
+	c.pmap = c.cfg.PortmapperClient
+	if c.pmap == nil {
+		c.pmap = NewPortmapper(net.JoinHostPort(host, "111"), &ClientConfig{Timeout: c.cfg.Timeout})
+		c.ownPmap = true
+	}
+	return c
+}
+
+// hostAddrKey identifies a service in hostAddrCache.
+type hostAddrKey struct {
+	pmap    string // address of the portmapper the service was looked up in
+	host    string
+	program uint32
+	version uint32
+	prot    string
+}
+
+var hostAddrMu sync.Mutex
+var hostAddrCache = make(map[hostAddrKey]string)
+
+// resolveAddr returns the address to dial to reach the service over the specified network
+// ("tcp" or "udp"). Unless useCache is true, the portmapper is queried even when the address
+// is cached.
+func (c *Client) resolveAddr(ctx context.Context, prot string, useCache bool) (string, error) {
+	if c.host == "" {
+		return c.Addr, nil
+	}
+
+	key := hostAddrKey{pmap: c.pmap.Addr, host: c.host, program: c.Program, version: c.Version, prot: prot}
+
+	if useCache {
+		hostAddrMu.Lock()
+		addr, found := hostAddrCache[key]
+		hostAddrMu.Unlock()
+		if found {
+			return addr, nil
+		}
+	}
+
+	port, err := lookupHostPort(ctx, c.pmap, c.host, c.Program, c.Version, prot)
+	if err != nil {
+		forgetHostAddr(key)
+		return "", err
+	}
+
+	addr := net.JoinHostPort(c.host, strconv.Itoa(port))
+	hostAddrMu.Lock()
+	hostAddrCache[key] = addr
+	hostAddrMu.Unlock()
+	return addr, nil
+}
+
+// forgetAddr drops the cached address of the service over prot, after a connection failure.
+func (c *Client) forgetAddr(prot string) {
+	if c.host != "" {
+		forgetHostAddr(hostAddrKey{pmap: c.pmap.Addr, host: c.host, program: c.Program, version: c.Version, prot: prot})
+	}
+}
+
+func forgetHostAddr(key hostAddrKey) {
+	hostAddrMu.Lock()
+	delete(hostAddrCache, key)
+	hostAddrMu.Unlock()
+}
+
+// lookupHostPort queries pmap for the port of a service running on host, using rpcbind
+// version 4 and falling back to version 2 of the portmapper protocol.
+func lookupHostPort(ctx context.Context, pmap *Portmapper, host string, program, version uint32, prot string) (int, error) {
+	netid := prot
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		netid += "6"
+	}
+
+	var uaddr string
+	mapping := RpcbindMapping{Program: program, Version: version, Netid: netid}
+	err := pmap.client.CallProgramContext(ctx, PortmapperProgram, RpcbindVersion4, RpcbindProcGetAddr, &mapping, &uaddr)
+	if err == nil {
+		if uaddr == "" {
+			return 0, ErrorPortmapperServiceDoesntExist
+		}
+		addr, err := UaddrToAddr(netid, uaddr)
+		if err != nil {
+			return 0, err
+		}
+		switch a := addr.(type) {
+		case *net.TCPAddr:
+			return a.Port, nil
+		case *net.UDPAddr:
+			return a.Port, nil
+		default:
+			return 0, errInvalidUaddr
+		}
+	}
+
+	// Old portmappers only speak version 2, which doesn't support IPv6
+	var mismatch *ErrProgMismatch
+	if !errors.As(err, &mismatch) || netid != prot {
+		return 0, err
+	}
+
+	protocol := Tcp
+	if prot == "udp" {
+		protocol = Udp
+	}
+
+	var port uint32
+	if err := pmap.client.CallContext(ctx, PortmapperPortGet, &pmapMapping{Program: program, Version: version, Protocol: protocol}, &port); err != nil {
+		return 0, err
+	}
+	if port == 0 {
+		return 0, ErrorPortmapperServiceDoesntExist
+	}
+	return int(port), nil
+}
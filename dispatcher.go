@@ -0,0 +1,256 @@
+package sunrpc
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Dispatcher routes incoming calls to the procedures registered for many programs and
+// versions, so that they can all be served behind a single listener (see
+// NewTCPServerWithDispatcher and NewUDPServerWithDispatcher).
+type Dispatcher struct {
+	mu       sync.RWMutex
+	programs map[uint32]map[uint32]*procTable
+}
+
+// procTable holds the procedures registered for a program version.
+type procTable struct {
+	procedures map[uint32]interface{}
+	procnames  map[uint32]string
+}
+
+// NewDispatcher creates a new Dispatcher, with no programs registered.
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{
+		programs: make(map[uint32]map[uint32]*procTable),
+	}
+}
+
+// Register binds a new RPC procedure ID of the specified program and version to a function.
+// It fails, leaving the procedure unbound, if the function doesn't have a valid handler
+// signature (see Server.Register).
+func (d *Dispatcher) Register(program, version, proc uint32, rcvr interface{}) error {
+	if err := checkHandler(rcvr); err != nil {
+		return fmt.Errorf("invalid handler for procedure %d: %v", proc, err)
+	}
+
+	d.mu.Lock()
+	d.table(program, version).procedures[proc] = rcvr
+	d.mu.Unlock()
+	return nil
+}
+
+// RegisterWithName is like Register, but also assigns a name to the procedure (used for logging).
+func (d *Dispatcher) RegisterWithName(program, version, proc uint32, rcvr interface{}, name string) error {
+	if err := checkHandler(rcvr); err != nil {
+		return fmt.Errorf("invalid handler for procedure %d (%s): %v", proc, name, err)
+	}
+
+	d.mu.Lock()
+	t := d.table(program, version)
+	t.procedures[proc] = rcvr
+	t.procnames[proc] = name
+	d.mu.Unlock()
+	return nil
+}
+
+// Program returns a ProcedureRegistry binding procedures of the specified program and version,
+// so that they can be registered with helpers like RegisterFunc.
+func (d *Dispatcher) Program(program, version uint32) ProcedureRegistry {
+	return dispatcherProgram{d, program, version}
+}
+
+// dispatcherProgram is the ProcedureRegistry of a program version of a Dispatcher.
+type dispatcherProgram struct {
+	d                *Dispatcher
+	program, version uint32
+}
+
+func (p dispatcherProgram) Register(proc uint32, rcvr interface{}) error {
+	return p.d.Register(p.program, p.version, proc, rcvr)
+}
+
+func (p dispatcherProgram) RegisterWithName(proc uint32, rcvr interface{}, name string) error {
+	return p.d.RegisterWithName(p.program, p.version, proc, rcvr, name)
+}
+
+// ProcedureTable can be implemented by services registered with RegisterService, to map the
+// names of their methods to procedure IDs.
+type ProcedureTable interface {
+	Procedures() map[string]uint32
+}
+
+// RegisterService binds procedures of the specified program and version to the methods of
+// rcvr (usually a pointer to a struct). The procedure ID of each method is looked up in the
+// table returned by rcvr.Procedures, if rcvr implements ProcedureTable; otherwise, methods are
+// bound by name, following the convention Proc<ID><Name> (eg: Proc0Null, Proc1Mnt), and other
+// methods are ignored. Procedures are named after the method (or <Name>, if not empty).
+//
+// Either all the procedures are registered, or none is: RegisterService fails if any of the
+// methods doesn't have a valid handler signature. It returns the names of the registered
+// procedures, by ID.
+func (d *Dispatcher) RegisterService(program, version uint32, rcvr interface{}) (map[uint32]string, error) {
+	v := reflect.ValueOf(rcvr)
+	if !v.IsValid() {
+		return nil, fmt.Errorf("invalid service: %v", rcvr)
+	}
+
+	procs := make(map[uint32]string)
+	handlers := make(map[uint32]interface{})
+	bind := func(proc uint32, name string, method reflect.Value) error {
+		if other, found := procs[proc]; found {
+			return fmt.Errorf("procedure %d bound to both %s and %s", proc, other, name)
+		}
+		rcvr := method.Interface()
+		if err := checkHandler(rcvr); err != nil {
+			return fmt.Errorf("invalid handler %s for procedure %d: %v", name, proc, err)
+		}
+		procs[proc] = name
+		handlers[proc] = rcvr
+		return nil
+	}
+
+	if table, ok := rcvr.(ProcedureTable); ok {
+		for name, proc := range table.Procedures() {
+			method := v.MethodByName(name)
+			if !method.IsValid() {
+				return nil, fmt.Errorf("service %T has no method %s", rcvr, name)
+			}
+			if err := bind(proc, name, method); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		t := v.Type()
+		for i := 0; i < t.NumMethod(); i++ {
+			proc, name, ok := parseProcMethodName(t.Method(i).Name)
+			if !ok {
+				continue
+			}
+			if err := bind(proc, name, v.Method(i)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	d.mu.Lock()
+	t := d.table(program, version)
+	for proc, rcvr := range handlers {
+		t.procedures[proc] = rcvr
+		t.procnames[proc] = procs[proc]
+	}
+	d.mu.Unlock()
+	return procs, nil
+}
+
+// parseProcMethodName parses the name of a method following the Proc<ID><Name> convention.
+func parseProcMethodName(method string) (proc uint32, name string, ok bool) {
+	if !strings.HasPrefix(method, "Proc") {
+		return 0, "", false
+	}
+	rest := method[len("Proc"):]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	n, err := strconv.ParseUint(rest[:digits], 10, 32)
+	if err != nil {
+		return 0, "", false
+	}
+
+	name = rest[digits:]
+	if name == "" {
+		name = method
+	}
+	return uint32(n), name, true
+}
+
+// table returns the procedure table of a program version, creating it if needed. d.mu must be held.
+func (d *Dispatcher) table(program, version uint32) *procTable {
+	versions, found := d.programs[program]
+	if !found {
+		versions = make(map[uint32]*procTable)
+		d.programs[program] = versions
+	}
+
+	t, found := versions[version]
+	if !found {
+		t = &procTable{
+			procedures: make(map[uint32]interface{}),
+			procnames:  make(map[uint32]string),
+		}
+		versions[version] = t
+	}
+	return t
+}
+
+// checkProgram checks whether the specified program and version are served. If the program
+// is served but not the version, it also returns the lowest and highest supported versions.
+func (d *Dispatcher) checkProgram(program, version uint32) (stat AcceptType, low, high uint32) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	versions, found := d.programs[program]
+	if !found {
+		return ProgUnavail, 0, 0
+	}
+	if _, found := versions[version]; found {
+		return Success, 0, 0
+	}
+
+	first := true
+	for v := range versions {
+		if first || v < low {
+			low = v
+		}
+		if first || v > high {
+			high = v
+		}
+		first = false
+	}
+	return ProgMismatch, low, high
+}
+
+// procedure returns the function (and its name) bound to a procedure.
+func (d *Dispatcher) procedure(program, version, proc uint32) (rcvr interface{}, name string, found bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	t, found := d.programs[program][version]
+	if !found {
+		return nil, "", false
+	}
+	rcvr, found = t.procedures[proc]
+	return rcvr, t.procnames[proc], found
+}
+
+// ProgramVersion identifies a version of an RPC program.
+type ProgramVersion struct {
+	Program uint32
+	Version uint32
+}
+
+// Programs returns all the program versions served by the dispatcher, sorted.
+func (d *Dispatcher) Programs() []ProgramVersion {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	var progs []ProgramVersion
+	for program, versions := range d.programs {
+		for version := range versions {
+			progs = append(progs, ProgramVersion{Program: program, Version: version})
+		}
+	}
+
+	sort.Slice(progs, func(i, j int) bool {
+		if progs[i].Program != progs[j].Program {
+			return progs[i].Program < progs[j].Program
+		}
+		return progs[i].Version < progs[j].Version
+	})
+	return progs
+}
@@ -0,0 +1,178 @@
+package sunrpc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcher(t *testing.T) {
+	const mountProgram = 100005
+
+	d := NewDispatcher()
+	d.Register(mountProgram, 1, 1, func(arg uint32, reply *uint32) error {
+		*reply = 1
+		return nil
+	})
+	d.RegisterWithName(mountProgram, 3, 1, func(arg uint32, reply *uint32) error {
+		*reply = 3
+		return nil
+	}, "MNT")
+	d.Register(PortmapperProgram, PortmapperVersion, 1, func(arg uint32, reply *uint32) error {
+		*reply = 100
+		return nil
+	})
+
+	assert.Equal(t, []ProgramVersion{
+		{Program: PortmapperProgram, Version: PortmapperVersion},
+		{Program: mountProgram, Version: 1},
+		{Program: mountProgram, Version: 3},
+	}, d.Programs())
+
+	s := newServerWithDispatcher(d, nil)
+
+	var reply uint32
+	for _, pv := range []ProgramVersion{{mountProgram, 1}, {mountProgram, 3}, {PortmapperProgram, PortmapperVersion}} {
+		client := NewClient("", pv.Program, pv.Version, nil)
+		assert.Nil(t, roundTripRecord(t, client, &s, 1, uint32(0), &reply))
+	}
+	assert.EqualValues(t, 100, reply)
+
+	client := NewClient("", mountProgram, 2, nil)
+	err := roundTripRecord(t, client, &s, 1, uint32(0), &reply)
+	assert.Equal(t, &ErrProgMismatch{Low: 1, High: 3}, err)
+
+	client = NewClient("", mountProgram+1, 1, nil)
+	err = roundTripRecord(t, client, &s, 1, uint32(0), &reply)
+	assert.Equal(t, &ErrProgUnavail{}, err)
+
+	client = NewClient("", mountProgram, 3, nil)
+	err = roundTripRecord(t, client, &s, 2, uint32(0), &reply)
+	assert.Equal(t, &ErrProcUnavail{}, err)
+
+	// Servers created with an empty Dispatcher have no program to register procedures to
+	empty := NewDispatcher()
+	srv := NewTCPServerWithDispatcher(empty)
+	handler := func(arg uint32, reply *uint32) error { return nil }
+	assert.Equal(t, ErrorNoDefaultProgram, srv.Register(1, handler))
+	assert.Equal(t, ErrorNoDefaultProgram, srv.RegisterWithName(1, handler, "PROC"))
+	_, err = srv.RegisterService(&mountService{})
+	assert.Equal(t, ErrorNoDefaultProgram, err)
+	assert.Empty(t, empty.Programs())
+}
+
+func TestDispatcherRegisterValidation(t *testing.T) {
+	type linkedList struct {
+		Value uint32
+		Next  *linkedList `xdr:"optional"`
+	}
+	type withChan struct {
+		Value uint32
+		C     chan int
+	}
+	type withUnexported struct {
+		Value uint32
+		c     chan int
+	}
+
+	valid := []interface{}{
+		func(arg struct{}, reply *struct{}) error { return nil },
+		func(arg *uint32, reply *[]string) error { return nil },
+		func(ctx *CallContext, arg linkedList, reply *linkedList) error { return nil },
+		func(arg withUnexported, reply *map[string]int64) error { return nil },
+		func(arg uint32, reply *interface{}) error { return nil },
+	}
+	for _, rcvr := range valid {
+		assert.Nil(t, NewDispatcher().Register(1, 1, 1, rcvr), "%T", rcvr)
+	}
+
+	invalid := []interface{}{
+		nil,
+		42,
+		func(arg uint32) error { return nil },
+		func(arg uint32, reply *uint32, other int) error { return nil },
+		func(ctx CallContext, arg uint32, reply *uint32) error { return nil },
+		func(arg uint32, reply uint32) error { return nil },
+		func(arg uint32, reply *uint32) {},
+		func(arg uint32, reply *uint32) (int, error) { return 0, nil },
+		func(arg uint32, reply *uint32) bool { return false },
+		func(arg withChan, reply *uint32) error { return nil },
+		func(arg uint32, reply *[]func()) error { return nil },
+		func(arg complex64, reply *uint32) error { return nil },
+		func(arg interface{}, reply *uint32) error { return nil },
+		func(arg uint32, args ...uint32) error { return nil },
+	}
+	for _, rcvr := range invalid {
+		d := NewDispatcher()
+		assert.NotNil(t, d.Register(1, 1, 1, rcvr), "%T", rcvr)
+		assert.NotNil(t, d.RegisterWithName(1, 1, 1, rcvr, "PROC"), "%T", rcvr)
+		assert.Empty(t, d.Programs())
+	}
+}
+
+type mountService struct {
+	mounts []string
+}
+
+func (m *mountService) Proc0(arg struct{}, reply *struct{}) error { return nil }
+
+func (m *mountService) Proc1Mnt(arg string, reply *uint32) error {
+	m.mounts = append(m.mounts, arg)
+	*reply = uint32(len(m.mounts))
+	return nil
+}
+
+func (m *mountService) Proc3Umnt(ctx *CallContext, arg string, reply *struct{}) error { return nil }
+
+func (m *mountService) Process(arg string) {}
+
+type tableService struct{}
+
+func (tableService) Procedures() map[string]uint32 {
+	return map[string]uint32{"Null": 0, "Double": 5}
+}
+
+func (tableService) Null(arg struct{}, reply *struct{}) error { return nil }
+
+func (tableService) Double(arg uint32, reply *uint32) error {
+	*reply = arg * 2
+	return nil
+}
+
+type brokenService struct{}
+
+func (brokenService) Proc0Null(arg struct{}, reply *struct{}) error { return nil }
+
+func (brokenService) Proc1Broken(arg uint32) error { return nil }
+
+func TestDispatcherRegisterService(t *testing.T) {
+	d := NewDispatcher()
+
+	procs, err := d.RegisterService(100005, 1, &mountService{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[uint32]string{0: "Proc0", 1: "Mnt", 3: "Umnt"}, procs)
+
+	procs, err = d.RegisterService(100005, 2, tableService{})
+	assert.Nil(t, err)
+	assert.Equal(t, map[uint32]string{0: "Null", 5: "Double"}, procs)
+
+	// Nothing is registered if any method is invalid
+	_, err = d.RegisterService(100005, 3, brokenService{})
+	assert.NotNil(t, err)
+	assert.Equal(t, []ProgramVersion{{100005, 1}, {100005, 2}}, d.Programs())
+
+	_, name, found := d.procedure(100005, 1, 1)
+	assert.True(t, found)
+	assert.Equal(t, "Mnt", name)
+
+	s := newServerWithDispatcher(d, nil)
+
+	var reply uint32
+	client := NewClient("", 100005, 1, nil)
+	assert.Nil(t, roundTripRecord(t, client, &s, 1, "/export", &reply))
+	assert.EqualValues(t, 1, reply)
+
+	client = NewClient("", 100005, 2, nil)
+	assert.Nil(t, roundTripRecord(t, client, &s, 5, uint32(21), &reply))
+	assert.EqualValues(t, 42, reply)
+}
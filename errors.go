@@ -1,6 +1,9 @@
 package sunrpc
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 type ErrRpcMismatch struct {
 	High, Low uint32
@@ -33,3 +36,69 @@ type ErrGarbageArgs struct{}
 func (e *ErrProgUnavail) Error() string { return "requested program unavailable" }
 func (e *ErrProcUnavail) Error() string { return "requested procedure unavailable" }
 func (e *ErrGarbageArgs) Error() string { return "garbage arguments for proc" }
+
+// ErrSystem is returned when the server fails to run the procedure (eg: because of a memory
+// allocation failure). Handlers return it, or any error without a specific RPC status, to
+// reply with SYSTEM_ERR.
+type ErrSystem struct{}
+
+func (e *ErrSystem) Error() string { return "remote system error" }
+
+// RPCStatusError is an error carrying an arbitrary RPC reply status. Handlers can return it
+// (or any of the package's errors above) to choose the exact accepted or denied reply sent to the
+// client; clients receive it for accepted replies with a status unknown to the package.
+type RPCStatusError struct {
+	Type   ReplyType  // Accepted or Denied
+	Accept AcceptType // status of Accepted replies (must not be Success)
+	Reject RejectStat // status of Denied replies
+	Auth   AuthStat   // reason of AuthError replies
+	// Versions supported by the server, for ProgMismatch and RpcMismatch replies
+	Low, High uint32
+}
+
+func (e *RPCStatusError) Error() string {
+	if e.Type == Accepted {
+		return fmt.Sprintf("RPC call failed with status %v", e.Accept)
+	}
+	return fmt.Sprintf("RPC call denied with status %v", e.Reject)
+}
+
+// rpcStatusOf returns the reply status that a server sends when a procedure fails with err.
+func rpcStatusOf(err error) RPCStatusError {
+	var (
+		statusErr      *RPCStatusError
+		rpcMismatch    *ErrRpcMismatch
+		authErr        *ErrAuth
+		progMismatch   *ErrProgMismatch
+		progUnavail    *ErrProgUnavail
+		procUnavail    *ErrProcUnavail
+		garbageArgsErr *ErrGarbageArgs
+	)
+
+	switch {
+	case errors.As(err, &statusErr):
+		return *statusErr
+	case errors.As(err, &rpcMismatch):
+		return RPCStatusError{Type: Denied, Reject: RpcMismatch, Low: rpcMismatch.Low, High: rpcMismatch.High}
+	case errors.As(err, &authErr):
+		return RPCStatusError{Type: Denied, Reject: AuthError, Auth: authErr.Stat}
+	case errors.As(err, &progMismatch):
+		return RPCStatusError{Type: Accepted, Accept: ProgMismatch, Low: progMismatch.Low, High: progMismatch.High}
+	case errors.As(err, &progUnavail):
+		return RPCStatusError{Type: Accepted, Accept: ProgUnavail}
+	case errors.As(err, &procUnavail):
+		return RPCStatusError{Type: Accepted, Accept: ProcUnavail}
+	case errors.As(err, &garbageArgsErr):
+		return RPCStatusError{Type: Accepted, Accept: GarbageArgs}
+	default:
+		return RPCStatusError{Type: Accepted, Accept: SystemErr}
+	}
+}
+
+// ErrTimeout is returned when no reply to a call is received within the configured timeout.
+type ErrTimeout struct{}
+
+func (e *ErrTimeout) Error() string { return "RPC call timed out" }
+
+// Timeout always returns true, so that ErrTimeout can be tested as a net.Error.
+func (e *ErrTimeout) Timeout() bool { return true }
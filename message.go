@@ -14,11 +14,15 @@ type AuthFlavor int32
 
 // All possible authentication flavors.
 const (
-	AuthFlavorNone AuthFlavor = iota
-	AuthFlavorUnix
-	AuthFlavorDes
+	AuthFlavorNone  AuthFlavor = 0
+	AuthFlavorUnix  AuthFlavor = 1
+	AuthFlavorShort AuthFlavor = 2
+	AuthFlavorDes   AuthFlavor = 3
 )
 
+// maxAuthBodySize is the maximum size of the body of an OpaqueAuth.
+const maxAuthBodySize = 400
+
 type OpaqueAuth struct {
 	Flavor AuthFlavor
 	Body   []byte // Must be between 0 and 400 bytes
@@ -32,6 +36,12 @@ type AuthUnix struct {
 	Gids        []uint32
 }
 
+// AuthShort is a shorthand credential previously issued by a server, that a client can send
+// in place of its full credentials.
+type AuthShort struct {
+	Handle []byte
+}
+
 //
 // RPC Message
 //
@@ -41,8 +51,8 @@ type MessageType int32
 
 // All possible RPC message types.
 const (
-	Call  MessageType = 0
-	Reply MessageType = 1
+	CallMessage  MessageType = 0
+	ReplyMessage MessageType = 1
 )
 
 // Message is an RPC message header.
@@ -115,7 +125,8 @@ const (
 type AuthStat uint32
 
 const (
-	AuthBadCred AuthStat = iota
+	AuthOk AuthStat = iota
+	AuthBadCred
 	AuthRejectedCred
 	AuthBadVerf
 	AUthRejectedVerf
@@ -159,7 +170,7 @@ type ProcedureReply struct {
 		MismatchInfo struct {
 			Low, High uint32
 		} `xdr:"unioncase=0"` // RpcMismatch
-		AuthStat AuthStat `xdr:"unioncase=0"` // AuthError
+		AuthStat AuthStat `xdr:"unioncase=1"` // AuthError
 	} `xdr:"unioncase=1"`
 }
 
@@ -171,7 +182,7 @@ func NewProcedureCall(program uint32, version uint32, procedure uint32) *Procedu
 	return &ProcedureCall{
 		Header: Message{
 			Xid:  uint32(atomic.AddInt32(&xidCounter, 1)),
-			Type: Call,
+			Type: CallMessage,
 		},
 		Body: CallBody{
 			RPCVersion: 2,
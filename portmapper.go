@@ -15,6 +15,8 @@ const (
 	PortmapperPortSet   = 1
 	PortmapperPortUnset = 2
 	PortmapperPortGet   = 3
+	PortmapperPortDump  = 4
+	PortmapperCallit    = 5
 )
 
 // PortmapperProtocol is an enumeration denoting whether the RPC server we are registering runs over
@@ -28,18 +30,83 @@ const (
 	Udp PortmapperProtocol = 17
 )
 
-type pmapMapping struct {
+// String returns the name of the protocol, as shown by rpcinfo.
+func (p PortmapperProtocol) String() string {
+	switch p {
+	case Tcp:
+		return "tcp"
+	case Udp:
+		return "udp"
+	default:
+		return fmt.Sprintf("PortmapperProtocol(%d)", uint32(p))
+	}
+}
+
+// PortmapperMapping is a service registration, as returned by PortmapperDump.
+type PortmapperMapping struct {
 	Program  uint32
 	Version  uint32
 	Protocol PortmapperProtocol
 	Port     uint32
 }
 
+// pmapMapping is the mapping argument of the portmapper procedures.
+type pmapMapping = PortmapperMapping
+
+// pmapList is the XDR linked list of mappings returned by PMAPPROC_DUMP.
+type pmapList struct {
+	Mapping pmapMapping
+	Next    *pmapList `xdr:"optional"`
+}
+
+// pmapDumpReply is the reply to PMAPPROC_DUMP: an optional pointer to the head of the list.
+type pmapDumpReply struct {
+	List *pmapList `xdr:"optional"`
+}
+
+// pmapCallArgs are the arguments of PMAPPROC_CALLIT: the call to be forwarded, with its
+// arguments already XDR-encoded.
+type pmapCallArgs struct {
+	Program   uint32
+	Version   uint32
+	Procedure uint32
+	Args      []byte
+}
+
+// pmapCallResult is the reply to PMAPPROC_CALLIT: the port of the called service, and its
+// XDR-encoded reply.
+type pmapCallResult struct {
+	Port   uint32
+	Result []byte
+}
+
+// Portmapper is a client of a Portmapper (rpcbind) server, at a configurable address.
+type Portmapper struct {
+	Addr   string
+	client *Client
+}
+
+// NewPortmapper creates a client for the Portmapper server at the specified address (in
+// net.Dial format, eg: "192.168.1.10:111"). cfg contains the optional configuration of the
+// underlying RPC client. Like NewClient, this function does not attempt any connection.
+func NewPortmapper(addr string, cfg *ClientConfig) *Portmapper {
+	return &Portmapper{
+		Addr:   addr,
+		client: NewClient(addr, PortmapperProgram, PortmapperVersion, cfg),
+	}
+}
+
+// DefaultPortmapper is the Portmapper server running on the current host, used by the
+// Portmapper* and Rpcbind* functions, and by servers to register themselves (unless
+// configured otherwise in ServerConfig).
+var DefaultPortmapper = NewPortmapper("127.0.0.1:111", nil)
+
 var pmapInit sync.Once
-var pmapClient *Client
 
 var (
-	ErrorPortmapperNotFound = errors.New("rpcbind server not found on localhost:111")
+	// ErrorPortmapperNotFound is returned by servers that cannot register to their portmapper,
+	// because it doesn't answer
+	ErrorPortmapperNotFound = errors.New("rpcbind server not found")
 
 	// ErrorPortmapperServiceExists is returned by a call to PortmapperSet if there is already a
 	// service registered for the specified triplet (program, version, protocol)
@@ -74,27 +141,25 @@ func PortmapperInit() {
 			act.Read(data[:])
 			act.Close()
 		}
-
-		pmapClient = NewClient("127.0.0.1:111", PortmapperProgram, PortmapperVersion, nil)
 	})
 }
 
-// PortmapperAvailable returns true if we can correctly communicate with the portmapper server
-func PortmapperAvailable() bool {
-	PortmapperInit()
+// Close closes the connection to the Portmapper server, if any.
+func (p *Portmapper) Close() {
+	p.client.Close()
+}
 
-	if err := pmapClient.Call(0, nil, nil); err != nil {
+// Available returns true if we can correctly communicate with the portmapper server
+func (p *Portmapper) Available() bool {
+	if err := p.client.Call(0, nil, nil); err != nil {
 		return false
 	}
 
 	return true
 }
 
-// PortmapperSet associates an RPC server with a Portmapper server running on the current host
-// (i.e.: 127.0.0.1).
-func PortmapperSet(program uint32, version uint32, protocol PortmapperProtocol, port uint32) error {
-	PortmapperInit()
-
+// Set associates an RPC server with the Portmapper server.
+func (p *Portmapper) Set(program uint32, version uint32, protocol PortmapperProtocol, port uint32) error {
 	mapping := pmapMapping{
 		Program:  program,
 		Version:  version,
@@ -103,8 +168,8 @@ func PortmapperSet(program uint32, version uint32, protocol PortmapperProtocol,
 	}
 
 	var ok bool
-	if err := pmapClient.Call(PortmapperPortSet, &mapping, &ok); err != nil {
-		return fmt.Errorf("cannot register to rpcbind server: %v", err)
+	if err := p.client.Call(PortmapperPortSet, &mapping, &ok); err != nil {
+		return fmt.Errorf("cannot register to rpcbind server: %w", err)
 	}
 
 	if !ok {
@@ -114,17 +179,17 @@ func PortmapperSet(program uint32, version uint32, protocol PortmapperProtocol,
 	return nil
 }
 
-func PortmapperUnset(program uint32, version uint32) error {
-	PortmapperInit()
-
+// Unset removes the association of all the protocols of an RPC server from the Portmapper
+// server.
+func (p *Portmapper) Unset(program uint32, version uint32) error {
 	mapping := pmapMapping{
 		Program: program,
 		Version: version,
 	}
 
 	var ok uint32
-	if err := pmapClient.Call(PortmapperPortUnset, &mapping, &ok); err != nil {
-		return fmt.Errorf("cannot deregister from rpcbind server: %v", err)
+	if err := p.client.Call(PortmapperPortUnset, &mapping, &ok); err != nil {
+		return fmt.Errorf("cannot deregister from rpcbind server: %w", err)
 	}
 
 	if ok != 1 {
@@ -134,9 +199,8 @@ func PortmapperUnset(program uint32, version uint32) error {
 	return nil
 }
 
-func PortmapperGet(program uint32, version uint32, protocol PortmapperProtocol) (uint32, error) {
-	PortmapperInit()
-
+// Get returns the port of an RPC server, or zero if it is not registered.
+func (p *Portmapper) Get(program uint32, version uint32, protocol PortmapperProtocol) (uint32, error) {
 	mapping := pmapMapping{
 		Program:  program,
 		Version:  version,
@@ -144,9 +208,53 @@ func PortmapperGet(program uint32, version uint32, protocol PortmapperProtocol)
 	}
 
 	var port uint32
-	if err := pmapClient.Call(PortmapperPortGet, &mapping, &port); err != nil {
-		return 0, fmt.Errorf("cannot query rpcbind server: %v", err)
+	if err := p.client.Call(PortmapperPortGet, &mapping, &port); err != nil {
+		return 0, fmt.Errorf("cannot query rpcbind server: %w", err)
 	}
 
 	return port, nil
 }
+
+// Dump returns all the services registered with the Portmapper server, like "rpcinfo -p" does.
+func (p *Portmapper) Dump() ([]PortmapperMapping, error) {
+	var reply pmapDumpReply
+	if err := p.client.Call(PortmapperPortDump, nil, &reply); err != nil {
+		return nil, fmt.Errorf("cannot query rpcbind server: %w", err)
+	}
+
+	var mappings []PortmapperMapping
+	for l := reply.List; l != nil; l = l.Next {
+		mappings = append(mappings, l.Mapping)
+	}
+	return mappings, nil
+}
+
+// PortmapperAvailable returns true if we can correctly communicate with the portmapper server
+func PortmapperAvailable() bool {
+	PortmapperInit()
+	return DefaultPortmapper.Available()
+}
+
+// PortmapperSet associates an RPC server with a Portmapper server running on the current host
+// (i.e.: 127.0.0.1).
+func PortmapperSet(program uint32, version uint32, protocol PortmapperProtocol, port uint32) error {
+	PortmapperInit()
+	return DefaultPortmapper.Set(program, version, protocol, port)
+}
+
+func PortmapperUnset(program uint32, version uint32) error {
+	PortmapperInit()
+	return DefaultPortmapper.Unset(program, version)
+}
+
+func PortmapperGet(program uint32, version uint32, protocol PortmapperProtocol) (uint32, error) {
+	PortmapperInit()
+	return DefaultPortmapper.Get(program, version, protocol)
+}
+
+// PortmapperDump returns all the services registered with the Portmapper server running on the
+// current host, like "rpcinfo -p" does.
+func PortmapperDump() ([]PortmapperMapping, error) {
+	PortmapperInit()
+	return DefaultPortmapper.Dump()
+}
@@ -0,0 +1,112 @@
+package sunrpc
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortmapper(t *testing.T) {
+	p := startPortmapperServer(t)
+	port := uint32(p.Addr().(*net.TCPAddr).Port)
+
+	pmap := NewPortmapper(p.Addr().String(), nil)
+	defer pmap.Close()
+
+	assert.True(t, pmap.Available())
+	assert.Nil(t, pmap.Set(1234, 1, Tcp, 5000))
+	assert.Equal(t, ErrorPortmapperServiceExists, pmap.Set(1234, 1, Tcp, 5000))
+
+	getport, err := pmap.Get(1234, 1, Tcp)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(5000), getport)
+
+	mappings, err := pmap.Dump()
+	assert.Nil(t, err)
+	assert.Equal(t, []PortmapperMapping{
+		{Program: PortmapperProgram, Version: PortmapperVersion, Protocol: Tcp, Port: port},
+		{Program: PortmapperProgram, Version: PortmapperVersion, Protocol: Udp, Port: port},
+		{Program: 1234, Version: 1, Protocol: Tcp, Port: 5000},
+	}, mappings)
+
+	assert.Nil(t, pmap.Unset(1234, 1))
+	assert.Equal(t, ErrorPortmapperServiceDoesntExist, pmap.Unset(1234, 1))
+
+	// PortmapperServer only speaks version 2
+	_, err = pmap.RpcbindGetAddr(1234, 1, "tcp")
+	assert.NotNil(t, err)
+}
+
+func TestPortmapperDump(t *testing.T) {
+	p := startPortmapperServer(t)
+	port := uint32(p.Addr().(*net.TCPAddr).Port)
+
+	// Point the package-level functions to the test portmapper
+	saved := DefaultPortmapper
+	DefaultPortmapper = NewPortmapper(p.Addr().String(), nil)
+	t.Cleanup(func() {
+		DefaultPortmapper.Close()
+		DefaultPortmapper = saved
+	})
+
+	assert.Nil(t, PortmapperSet(1234, 1, Udp, 5000))
+	assert.Nil(t, PortmapperSet(1234, 2, Tcp, 5001))
+
+	mappings, err := PortmapperDump()
+	assert.Nil(t, err)
+	assert.Equal(t, []PortmapperMapping{
+		{Program: PortmapperProgram, Version: PortmapperVersion, Protocol: Tcp, Port: port},
+		{Program: PortmapperProgram, Version: PortmapperVersion, Protocol: Udp, Port: port},
+		{Program: 1234, Version: 1, Protocol: Udp, Port: 5000},
+		{Program: 1234, Version: 2, Protocol: Tcp, Port: 5001},
+	}, mappings)
+}
+
+func TestServerRegistration(t *testing.T) {
+	p := startPortmapperServer(t)
+	pmap := NewPortmapper(p.Addr().String(), nil)
+	defer pmap.Close()
+
+	d := NewDispatcher()
+	d.Register(1234, 1, 0, func(arg struct{}, reply *struct{}) error { return nil })
+	d.Register(1234, 3, 0, func(arg struct{}, reply *struct{}) error { return nil })
+
+	// Ephemeral ports: the actual bound port is registered
+	tsrv := NewTCPServerWithDispatcher(d)
+	tsrv.SetConfig(&ServerConfig{PortmapperClient: pmap})
+	assert.Nil(t, tsrv.Serve("127.0.0.1:0"))
+	usrv := NewUDPServerWithDispatcher(d)
+	usrv.SetConfig(&ServerConfig{PortmapperClient: pmap})
+	assert.Nil(t, usrv.Serve("127.0.0.1:0"))
+
+	for _, version := range []uint32{1, 3} {
+		port, err := pmap.Get(1234, version, Tcp)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(tsrv.Addr().(*net.TCPAddr).Port), port)
+
+		port, err = pmap.Get(1234, version, Udp)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(usrv.Addr().(*net.UDPAddr).Port), port)
+	}
+
+	// Shutdown unregisters all the versions, only for its own protocol
+	assert.Nil(t, tsrv.Shutdown(context.Background()))
+	for _, version := range []uint32{1, 3} {
+		port, err := pmap.Get(1234, version, Tcp)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(0), port)
+
+		port, err = pmap.Get(1234, version, Udp)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(usrv.Addr().(*net.UDPAddr).Port), port)
+	}
+
+	assert.Nil(t, usrv.Close())
+	for _, version := range []uint32{1, 3} {
+		port, err := pmap.Get(1234, version, Udp)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(0), port)
+	}
+}
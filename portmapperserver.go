@@ -0,0 +1,311 @@
+package sunrpc
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PortmapperCallitTimeout is the maximum time a PortmapperServer waits for the reply of a
+// service to a call forwarded through PMAPPROC_CALLIT.
+const PortmapperCallitTimeout = 5 * time.Second
+
+// portmapperCallitMaxPending is the maximum number of calls forwarded through PMAPPROC_CALLIT
+// at the same time; further calls are dropped.
+const portmapperCallitMaxPending = 32
+
+// PortmapperServer is a pure-Go implementation of the portmapper service (version 2 of the
+// protocol), serving over both TCP and UDP on the same port. It can be embedded in a process
+// (eg: in tests, or on devices without a system rpcbind), or run as a standalone daemon.
+//
+// Registrations are kept in memory, and lost when the server stops.
+type PortmapperServer struct {
+	tcp *TCPServer
+	udp *UDPServer
+
+	mu       sync.Mutex
+	mappings []pmapMapping
+	closing  bool // set when the server stops, so that no more calls are forwarded
+
+	callits  chan struct{}  // semaphore limiting the pending PMAPPROC_CALLIT calls
+	callitWg sync.WaitGroup // PMAPPROC_CALLIT calls being forwarded
+}
+
+// NewPortmapperServer creates a new PortmapperServer, with an empty registration table.
+func NewPortmapperServer() *PortmapperServer {
+	p := &PortmapperServer{
+		callits: make(chan struct{}, portmapperCallitMaxPending),
+	}
+
+	d := NewDispatcher()
+	for _, proc := range []struct {
+		proc uint32
+		rcvr interface{}
+		name string
+	}{
+		{0, p.null, "PMAPPROC_NULL"},
+		{PortmapperPortSet, p.set, "PMAPPROC_SET"},
+		{PortmapperPortUnset, p.unset, "PMAPPROC_UNSET"},
+		{PortmapperPortGet, p.getport, "PMAPPROC_GETPORT"},
+		{PortmapperPortDump, p.dump, "PMAPPROC_DUMP"},
+		{PortmapperCallit, p.callit, "PMAPPROC_CALLIT"},
+	} {
+		if err := d.RegisterWithName(PortmapperProgram, PortmapperVersion, proc.proc, proc.rcvr, proc.name); err != nil {
+			// The procedures are known to have valid signatures
+			panic(err)
+		}
+	}
+
+	// The portmapper obviously doesn't register to another portmapper
+	cfg := &ServerConfig{Portmapper: PortmapperNone}
+
+	p.tcp = NewTCPServerWithDispatcher(d).(*TCPServer)
+	p.tcp.SetConfig(cfg)
+	p.udp = NewUDPServerWithDispatcher(d).(*UDPServer)
+	p.udp.SetConfig(cfg)
+
+	return p
+}
+
+// Serve starts the portmapper on the specified address (usually ":111"), over both TCP and
+// UDP. If the address specifies port 0, an ephemeral port is bound, and reported by Addr.
+func (p *PortmapperServer) Serve(addr string) error {
+	listener, err := net.Listen("tcp4", addr)
+	if err != nil {
+		return err
+	}
+
+	// Bind UDP on the same port that was bound for TCP
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	udpAddr, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	conn, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	// Like rpcbind, list the portmapper itself among the registered services (replacing the
+	// mappings of a previous Serve, if any)
+	p.mu.Lock()
+	mappings := p.mappings[:0]
+	for _, m := range p.mappings {
+		if m.Program != PortmapperProgram {
+			mappings = append(mappings, m)
+		}
+	}
+	p.mappings = append(mappings,
+		pmapMapping{Program: PortmapperProgram, Version: PortmapperVersion, Protocol: Tcp, Port: uint32(port)},
+		pmapMapping{Program: PortmapperProgram, Version: PortmapperVersion, Protocol: Udp, Port: uint32(port)})
+	p.mu.Unlock()
+
+	if err := p.tcp.ServeListener(listener); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := p.udp.ServePacketConn(conn); err != nil {
+		p.tcp.Close()
+		return err
+	}
+	return nil
+}
+
+// Addr returns the TCP address the portmapper is listening on (UDP is served on the same
+// port), or nil if it is not serving yet.
+func (p *PortmapperServer) Addr() net.Addr {
+	return p.tcp.Addr()
+}
+
+// Shutdown gracefully stops the portmapper, waiting for in-flight calls (including those
+// forwarded through PMAPPROC_CALLIT) to complete.
+func (p *PortmapperServer) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closing = true
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.callitWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		p.Close()
+		return ctx.Err()
+	}
+
+	errTcp := p.tcp.Shutdown(ctx)
+	errUdp := p.udp.Shutdown(ctx)
+	if errTcp != nil {
+		return errTcp
+	}
+	return errUdp
+}
+
+// Close immediately stops the portmapper, aborting the calls forwarded through
+// PMAPPROC_CALLIT.
+func (p *PortmapperServer) Close() error {
+	p.mu.Lock()
+	p.closing = true
+	p.mu.Unlock()
+
+	errTcp := p.tcp.Close()
+	errUdp := p.udp.Close()
+	p.callitWg.Wait()
+	if errTcp != nil {
+		return errTcp
+	}
+	return errUdp
+}
+
+//
+// Procedures
+//
+
+func (p *PortmapperServer) null(arg struct{}, reply *struct{}) error {
+	return nil
+}
+
+// set registers a mapping, unless the (program, version, protocol) triplet is already
+// registered.
+func (p *PortmapperServer) set(arg pmapMapping, reply *bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, m := range p.mappings {
+		if m.Program == arg.Program && m.Version == arg.Version && m.Protocol == arg.Protocol {
+			*reply = false
+			return nil
+		}
+	}
+
+	p.mappings = append(p.mappings, arg)
+	*reply = true
+	return nil
+}
+
+// unset removes the mappings of all protocols for the program version.
+func (p *PortmapperServer) unset(arg pmapMapping, reply *bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	mappings := p.mappings[:0]
+	for _, m := range p.mappings {
+		if m.Program == arg.Program && m.Version == arg.Version {
+			*reply = true
+			continue
+		}
+		mappings = append(mappings, m)
+	}
+	p.mappings = mappings
+	return nil
+}
+
+// getport returns the port of a mapping, or zero if it is not registered.
+func (p *PortmapperServer) getport(arg pmapMapping, reply *uint32) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, m := range p.mappings {
+		if m.Program == arg.Program && m.Version == arg.Version && m.Protocol == arg.Protocol {
+			*reply = m.Port
+			return nil
+		}
+	}
+	return nil
+}
+
+// dump returns all the registered mappings.
+func (p *PortmapperServer) dump(arg struct{}, reply *pmapDumpReply) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Build the list backwards, so that it follows the registration order
+	for i := len(p.mappings) - 1; i >= 0; i-- {
+		reply.List = &pmapList{Mapping: p.mappings[i], Next: reply.List}
+	}
+	return nil
+}
+
+// callit forwards a call to a local service registered over UDP. The call is forwarded in
+// background, so that the portmapper keeps serving other calls meanwhile, and the reply is sent
+// once the service replies.
+//
+// As mandated by the protocol, failed calls get no reply at all, so that broadcast callers only
+// hear from hosts where the call succeeded. Like rpcbind, calls to the portmapper itself are
+// refused, and CALLIT is only supported over UDP.
+func (p *PortmapperServer) callit(cc *CallContext, arg pmapCallArgs, reply *pmapCallResult) error {
+	if !strings.HasPrefix(cc.Transport, "udp") {
+		return &ErrProcUnavail{}
+	}
+	if arg.Program == PortmapperProgram {
+		return errNoReply
+	}
+
+	var port uint32
+	p.getport(pmapMapping{Program: arg.Program, Version: arg.Version, Protocol: Udp}, &port)
+	if port == 0 {
+		return errNoReply
+	}
+
+	select {
+	case p.callits <- struct{}{}:
+	default:
+		p.udp.log.Warn("Too many pending PMAPPROC_CALLIT calls, dropping call")
+		return errNoReply
+	}
+
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		<-p.callits
+		return errNoReply
+	}
+	p.callitWg.Add(1)
+	p.mu.Unlock()
+
+	go func(cc CallContext) {
+		defer p.callitWg.Done()
+		defer func() { <-p.callits }()
+
+		c := NewClient(net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))), arg.Program, arg.Version,
+			&ClientConfig{Transport: ClientTransportUdpOnly, Timeout: PortmapperCallitTimeout})
+		defer c.Close()
+
+		var result rawXDR
+		if err := c.CallContext(cc, arg.Procedure, rawXDR(arg.Args), &result); err != nil {
+			p.udp.log.WithField("err", err).Debug("Forwarded PMAPPROC_CALLIT call failed")
+			return
+		}
+
+		var buf bytes.Buffer
+		ret := pmapCallResult{Port: port, Result: result}
+		if err := p.udp.WriteReplyMessage(&buf, cc.Xid, Success, &ret); err != nil {
+			p.udp.log.WithField("err", err).Error("Cannot encode PMAPPROC_CALLIT reply")
+			return
+		}
+
+		p.udp.mu.Lock()
+		conn := p.udp.conn
+		p.udp.mu.Unlock()
+		if _, err := conn.WriteTo(buf.Bytes(), cc.RemoteAddr); err != nil {
+			p.udp.log.WithField("err", err).Error("Cannot send PMAPPROC_CALLIT reply")
+		}
+	}(*cc)
+
+	return errNoReply
+}
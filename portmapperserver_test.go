@@ -0,0 +1,228 @@
+package sunrpc
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rasky/go-xdr/xdr2"
+	"github.com/stretchr/testify/assert"
+)
+
+func startPortmapperServer(t *testing.T) *PortmapperServer {
+	p := NewPortmapperServer()
+	if err := p.Serve("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+func TestPortmapperServer(t *testing.T) {
+	p := startPortmapperServer(t)
+	port := uint32(p.Addr().(*net.TCPAddr).Port)
+
+	for _, transport := range []ClientTransport{ClientTransportTcpOnly, ClientTransportUdpOnly} {
+		c := NewClient(p.Addr().String(), PortmapperProgram, PortmapperVersion,
+			&ClientConfig{Transport: transport, Timeout: time.Second})
+		defer c.Close()
+
+		var ok bool
+		assert.Nil(t, c.Call(PortmapperPortSet, &pmapMapping{Program: 1234, Version: 1, Protocol: Tcp, Port: 5000}, &ok))
+		assert.True(t, ok)
+		assert.Nil(t, c.Call(PortmapperPortSet, &pmapMapping{Program: 1234, Version: 1, Protocol: Tcp, Port: 5001}, &ok))
+		assert.False(t, ok)
+		assert.Nil(t, c.Call(PortmapperPortSet, &pmapMapping{Program: 1234, Version: 1, Protocol: Udp, Port: 5002}, &ok))
+		assert.True(t, ok)
+
+		var getport uint32
+		assert.Nil(t, c.Call(PortmapperPortGet, &pmapMapping{Program: 1234, Version: 1, Protocol: Tcp}, &getport))
+		assert.Equal(t, uint32(5000), getport)
+		assert.Nil(t, c.Call(PortmapperPortGet, &pmapMapping{Program: 1234, Version: 2, Protocol: Tcp}, &getport))
+		assert.Equal(t, uint32(0), getport)
+
+		var dump pmapDumpReply
+		assert.Nil(t, c.Call(PortmapperPortDump, nil, &dump))
+		var mappings []pmapMapping
+		for l := dump.List; l != nil; l = l.Next {
+			mappings = append(mappings, l.Mapping)
+		}
+		assert.Equal(t, []pmapMapping{
+			{Program: PortmapperProgram, Version: PortmapperVersion, Protocol: Tcp, Port: port},
+			{Program: PortmapperProgram, Version: PortmapperVersion, Protocol: Udp, Port: port},
+			{Program: 1234, Version: 1, Protocol: Tcp, Port: 5000},
+			{Program: 1234, Version: 1, Protocol: Udp, Port: 5002},
+		}, mappings)
+
+		// Unset removes all the protocols
+		assert.Nil(t, c.Call(PortmapperPortUnset, &pmapMapping{Program: 1234, Version: 1}, &ok))
+		assert.True(t, ok)
+		assert.Nil(t, c.Call(PortmapperPortUnset, &pmapMapping{Program: 1234, Version: 1}, &ok))
+		assert.False(t, ok)
+		assert.Nil(t, c.Call(PortmapperPortGet, &pmapMapping{Program: 1234, Version: 1, Protocol: Udp}, &getport))
+		assert.Equal(t, uint32(0), getport)
+	}
+}
+
+func TestPortmapperServerCallit(t *testing.T) {
+	p := startPortmapperServer(t)
+
+	srv := NewUDPServer(1234, 1).(*UDPServer)
+	srv.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	srv.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg + 1
+		return nil
+	})
+	serveUDP(t, srv)
+	port := uint32(srv.Addr().(*net.UDPAddr).Port)
+
+	c := NewClient(p.Addr().String(), PortmapperProgram, PortmapperVersion,
+		&ClientConfig{Transport: ClientTransportUdpOnly, Timeout: time.Second})
+	defer c.Close()
+
+	var args bytes.Buffer
+	xdr.Marshal(&args, uint32(41))
+
+	// Failed calls get no reply: the program is not registered yet, or it is the portmapper
+	// itself
+	noReply := NewClient(p.Addr().String(), PortmapperProgram, PortmapperVersion,
+		&ClientConfig{Transport: ClientTransportUdpOnly, Timeout: 200 * time.Millisecond})
+	defer noReply.Close()
+	var res pmapCallResult
+	assert.Equal(t, &ErrTimeout{}, noReply.Call(PortmapperCallit, &pmapCallArgs{Program: 1234, Version: 1, Procedure: 1, Args: args.Bytes()}, &res))
+	assert.Equal(t, &ErrTimeout{}, noReply.Call(PortmapperCallit, &pmapCallArgs{Program: PortmapperProgram, Version: PortmapperVersion, Procedure: PortmapperPortGet}, &res))
+
+	var ok bool
+	assert.Nil(t, c.Call(PortmapperPortSet, &pmapMapping{Program: 1234, Version: 1, Protocol: Udp, Port: port}, &ok))
+	assert.True(t, ok)
+
+	assert.Nil(t, c.Call(PortmapperCallit, &pmapCallArgs{Program: 1234, Version: 1, Procedure: 1, Args: args.Bytes()}, &res))
+	assert.Equal(t, port, res.Port)
+
+	var reply uint32
+	_, err := xdr.Unmarshal(bytes.NewReader(res.Result), &reply)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(42), reply)
+
+	// Forwarded calls don't block the portmapper
+	release := make(chan struct{})
+	srv.Register(2, func(arg uint32, reply *uint32) error {
+		<-release
+		return nil
+	})
+	go noReply.Call(PortmapperCallit, &pmapCallArgs{Program: 1234, Version: 1, Procedure: 2, Args: args.Bytes()}, &pmapCallResult{})
+	time.Sleep(50 * time.Millisecond)
+	var getport uint32
+	start := time.Now()
+	assert.Nil(t, c.Call(PortmapperPortGet, &pmapMapping{Program: 1234, Version: 1, Protocol: Udp}, &getport))
+	assert.True(t, time.Since(start) < 200*time.Millisecond)
+	close(release)
+
+	// CALLIT is only supported over UDP
+	tc := NewClient(p.Addr().String(), PortmapperProgram, PortmapperVersion,
+		&ClientConfig{Transport: ClientTransportTcpOnly, Timeout: time.Second})
+	defer tc.Close()
+	assert.Equal(t, &ErrProcUnavail{}, tc.Call(PortmapperCallit, &pmapCallArgs{Program: 1234, Version: 1, Procedure: 1, Args: args.Bytes()}, &res))
+}
+
+func TestPortmapperBroadcast(t *testing.T) {
+	p := startPortmapperServer(t)
+
+	srv := NewUDPServer(1234, 1).(*UDPServer)
+	srv.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	srv.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg + 1
+		return nil
+	})
+	serveUDP(t, srv)
+	port := uint32(srv.Addr().(*net.UDPAddr).Port)
+
+	c := NewClient(p.Addr().String(), PortmapperProgram, PortmapperVersion,
+		&ClientConfig{Transport: ClientTransportUdpOnly, Timeout: time.Second})
+	defer c.Close()
+	var ok bool
+	assert.Nil(t, c.Call(PortmapperPortSet, &pmapMapping{Program: 1234, Version: 1, Protocol: Udp, Port: port}, &ok))
+
+	// Replies are collected until the deadline, and retransmissions don't cause duplicates
+	cfg := &ClientConfig{RetransmitInitial: 20 * time.Millisecond, RetransmitTotal: 200 * time.Millisecond}
+	start := time.Now()
+	replies, err := PortmapperBroadcast(context.Background(), p.Addr().String(), 1234, 1, 1, uint32(9), cfg)
+	assert.Nil(t, err)
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+
+	if assert.Len(t, replies, 1) {
+		assert.Equal(t, "127.0.0.1", replies[0].Addr.IP.String())
+		assert.Equal(t, port, replies[0].Port)
+
+		var reply uint32
+		assert.Nil(t, replies[0].Decode(&reply))
+		assert.Equal(t, uint32(10), reply)
+	}
+
+	// Failed calls get no reply, so there is nothing to collect
+	replies, err = PortmapperBroadcast(context.Background(), p.Addr().String(), 4321, 1, 1, uint32(9), cfg)
+	assert.Nil(t, err)
+	assert.Len(t, replies, 0)
+
+	// Cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	_, err = PortmapperBroadcast(ctx, p.Addr().String(), 1234, 1, 1, uint32(9), &ClientConfig{Timeout: 5 * time.Second})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestPortmapperServerShutdown(t *testing.T) {
+	p := startPortmapperServer(t)
+
+	pmap := NewPortmapper(p.Addr().String(), nil)
+	defer pmap.Close()
+
+	release := make(chan struct{})
+	srv := NewUDPServer(1234, 1).(*UDPServer)
+	srv.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	srv.Register(1, func(arg uint32, reply *uint32) error {
+		<-release
+		*reply = arg + 1
+		return nil
+	})
+	serveUDP(t, srv)
+	assert.Nil(t, pmap.Set(1234, 1, Udp, uint32(srv.Addr().(*net.UDPAddr).Port)))
+
+	c := NewClient(p.Addr().String(), PortmapperProgram, PortmapperVersion,
+		&ClientConfig{Transport: ClientTransportUdpOnly, Timeout: 5 * time.Second})
+	defer c.Close()
+
+	var args bytes.Buffer
+	xdr.Marshal(&args, uint32(41))
+	var res pmapCallResult
+	callErr := make(chan error, 1)
+	go func() {
+		callErr <- c.Call(PortmapperCallit, &pmapCallArgs{Program: 1234, Version: 1, Procedure: 1, Args: args.Bytes()}, &res)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Shutdown waits for the forwarded call, whose reply is still delivered
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- p.Shutdown(context.Background()) }()
+	select {
+	case <-shutdownErr:
+		t.Fatal("Shutdown returned before the forwarded call completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	assert.Nil(t, <-callErr)
+	assert.Nil(t, <-shutdownErr)
+
+	var reply uint32
+	_, err := xdr.Unmarshal(bytes.NewReader(res.Result), &reply)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(42), reply)
+
+	// Serving again doesn't duplicate the mappings of the portmapper itself
+	assert.Equal(t, ErrorServerClosed, p.Serve("127.0.0.1:0"))
+	assert.Equal(t, ErrorServerClosed, p.Serve("127.0.0.1:0"))
+	assert.Len(t, p.mappings, 3)
+}
@@ -0,0 +1,256 @@
+package sunrpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// recordReadBufferSize is the size of the buffer used by RecordReader to read fragments.
+const recordReadBufferSize = 4 * 1024
+
+var recordReadBufPool = sync.Pool{
+	New: func() interface{} {
+		data := make([]byte, recordReadBufferSize)
+		return &data
+	},
+}
+
+var recordWriteBufPool = sync.Pool{
+	New: func() interface{} {
+		data := make([]byte, 4+MaxFragmentSize)
+		return &data
+	},
+}
+
+var errEmptyFragment = errors.New("A TCP record must be at least one byte in size")
+
+// RecordReader reads the records of a record-marked stream (RFC 5531, Section 11), such as
+// RPC-over-TCP. Each record is exposed as an io.Reader, so that it can be decoded while it is
+// received, without holding it in memory as a whole.
+//
+// RecordReader never reads past the end of the current fragment, so the underlying reader is
+// left positioned exactly at the end of the record.
+type RecordReader struct {
+	r       io.Reader
+	maxSize int
+
+	buf        *[]byte // pooled buffer, holding data of the current fragment
+	start, end int     // buffered data not consumed yet
+
+	inRecord  bool  // whether Next was called, and the record wasn't discarded yet
+	remaining int   // bytes of the current fragment not read from r yet
+	last      bool  // whether the current fragment is the last one of the record
+	size      int   // size of the record, as far as it was read
+	err       error // sticky error for the current record
+}
+
+// NewRecordReader creates a RecordReader reading from r. Records larger than maxSize bytes
+// cannot be read: reading them fails with ErrorRecordTooLarge.
+func NewRecordReader(r io.Reader, maxSize int) *RecordReader {
+	return &RecordReader{r: r, maxSize: maxSize}
+}
+
+// Next discards what is left of the current record (if any), and waits for the beginning of the
+// next one, which is then available for reading. It returns io.EOF if the stream ends before a
+// new record begins.
+func (rr *RecordReader) Next() error {
+	if err := rr.Discard(); err != nil {
+		return err
+	}
+
+	if err := rr.readMarker(); err != nil {
+		return err
+	}
+	rr.inRecord = true
+	return rr.err
+}
+
+// Read reads data of the current record. It returns io.EOF at the end of the record.
+func (rr *RecordReader) Read(p []byte) (int, error) {
+	if rr.err != nil {
+		return 0, rr.err
+	}
+
+	for rr.start == rr.end {
+		if !rr.inRecord {
+			return 0, io.EOF
+		}
+
+		if rr.remaining == 0 {
+			if rr.last {
+				return 0, io.EOF
+			}
+			if err := rr.readMarker(); err != nil {
+				rr.err = err
+				return 0, err
+			}
+			if rr.err != nil {
+				return 0, rr.err
+			}
+			continue
+		}
+
+		if rr.buf == nil {
+			rr.buf = recordReadBufPool.Get().(*[]byte)
+		}
+		n := len(*rr.buf)
+		if rr.remaining < n {
+			n = rr.remaining
+		}
+
+		n, err := rr.r.Read((*rr.buf)[:n])
+		rr.start, rr.end = 0, n
+		rr.remaining -= n
+		if n == 0 && err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			rr.err = err
+			return 0, err
+		}
+	}
+
+	n := copy(p, (*rr.buf)[rr.start:rr.end])
+	rr.start += n
+	return n, nil
+}
+
+// readTooLarge reads the beginning of a record that failed with ErrorRecordTooLarge, ignoring
+// the limit, so that the caller can still identify it (eg: to reply to it).
+func (rr *RecordReader) readTooLarge(p []byte) error {
+	if rr.err != ErrorRecordTooLarge {
+		return rr.err
+	}
+
+	rr.err = nil
+	_, err := io.ReadFull(rr, p)
+	rr.err = ErrorRecordTooLarge
+	return err
+}
+
+// Discard skips what is left of the current record, so that the stream is positioned at the
+// beginning of the next one.
+func (rr *RecordReader) Discard() error {
+	if !rr.inRecord {
+		return nil
+	}
+
+	for {
+		if rr.remaining > 0 {
+			if _, err := io.CopyN(ioutil.Discard, rr.r, int64(rr.remaining)); err != nil {
+				return err
+			}
+			rr.remaining = 0
+		}
+		if rr.last {
+			break
+		}
+		if err := rr.readMarker(); err != nil {
+			return err
+		}
+	}
+
+	if rr.buf != nil {
+		recordReadBufPool.Put(rr.buf)
+		rr.buf = nil
+	}
+	rr.start, rr.end = 0, 0
+	rr.inRecord = false
+	rr.size = 0
+	rr.err = nil
+	return nil
+}
+
+// readMarker reads the marker of the next fragment of the record.
+func (rr *RecordReader) readMarker() error {
+	var marker [4]byte
+	if _, err := io.ReadFull(rr.r, marker[:]); err != nil {
+		if err == io.EOF && rr.inRecord {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	size, last := ParseRecordMarker(binary.BigEndian.Uint32(marker[:]))
+	if size < 1 {
+		return errEmptyFragment
+	}
+
+	rr.remaining = int(size)
+	rr.last = last
+	rr.size += int(size)
+	if rr.size > rr.maxSize {
+		rr.err = ErrorRecordTooLarge
+	}
+	return nil
+}
+
+// RecordWriter writes a record on a record-marked stream (RFC 5531, Section 11), such as
+// RPC-over-TCP. Data is buffered and sent in fragments of up to MaxFragmentSize bytes, so that
+// large records can be streamed without holding them in memory as a whole.
+type RecordWriter struct {
+	w   io.Writer
+	buf *[]byte // pooled buffer: room for the record marker, followed by the fragment data
+	n   int     // fragment data in buf
+	err error
+}
+
+// NewRecordWriter creates a RecordWriter writing to w.
+func NewRecordWriter(w io.Writer) *RecordWriter {
+	return &RecordWriter{w: w}
+}
+
+// Write appends data to the record, sending a fragment every time MaxFragmentSize bytes are
+// buffered.
+func (rw *RecordWriter) Write(p []byte) (int, error) {
+	if rw.err != nil {
+		return 0, rw.err
+	}
+	if rw.buf == nil {
+		rw.buf = recordWriteBufPool.Get().(*[]byte)
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// Only send a full fragment when there is more data, as the last fragment can't be empty
+		if rw.n == MaxFragmentSize {
+			if err := rw.flush(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy((*rw.buf)[4+rw.n:], p)
+		rw.n += n
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close sends the last fragment, terminating the record. Afterwards, the RecordWriter can be
+// used to write a new record. Nothing is sent if no data was written, as records can't be empty.
+func (rw *RecordWriter) Close() error {
+	if rw.err != nil {
+		return rw.err
+	}
+	if rw.buf == nil {
+		return nil
+	}
+
+	err := rw.flush(true)
+	recordWriteBufPool.Put(rw.buf)
+	rw.buf = nil
+	return err
+}
+
+// flush sends the buffered data as a fragment, with a single Write call.
+func (rw *RecordWriter) flush(last bool) error {
+	binary.BigEndian.PutUint32(*rw.buf, NewRecordMarker(uint32(rw.n), last))
+	_, err := rw.w.Write((*rw.buf)[:4+rw.n])
+	rw.n = 0
+	rw.err = err
+	return err
+}
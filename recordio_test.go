@@ -0,0 +1,96 @@
+package sunrpc
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordWriterReader(t *testing.T) {
+	var stream bytes.Buffer
+
+	large := make([]byte, 2*MaxFragmentSize+100)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+
+	// Write the large record in small chunks, it is split in fragments
+	rw := NewRecordWriter(&stream)
+	for data := large; len(data) > 0; data = data[1000:] {
+		if len(data) < 1000 {
+			rw.Write(data)
+			break
+		}
+		rw.Write(data[:1000])
+	}
+	assert.Nil(t, rw.Close())
+
+	// The writer can be reused for more records
+	rw.Write([]byte{1, 2, 3})
+	assert.Nil(t, rw.Close())
+	rw.Write([]byte{4, 5, 6})
+	assert.Nil(t, rw.Close())
+
+	// The stream is the same written by WriteRecord
+	var expected bytes.Buffer
+	WriteRecord(&expected, large)
+	WriteRecord(&expected, []byte{1, 2, 3})
+	WriteRecord(&expected, []byte{4, 5, 6})
+	assert.Equal(t, expected.Bytes(), stream.Bytes())
+
+	rr := NewRecordReader(&stream, len(large))
+
+	// Before Next, there's nothing to read
+	n, err := rr.Read(make([]byte, 10))
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+
+	assert.Nil(t, rr.Next())
+	data, err := io.ReadAll(rr)
+	assert.Nil(t, err)
+	assert.Equal(t, large, data)
+
+	// Partially read the second record, the rest is skipped by Next
+	assert.Nil(t, rr.Next())
+	buf := make([]byte, 1)
+	n, err = rr.Read(buf)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, byte(1), buf[0])
+
+	assert.Nil(t, rr.Next())
+	data, err = io.ReadAll(rr)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{4, 5, 6}, data)
+
+	assert.Equal(t, io.EOF, rr.Next())
+}
+
+func TestRecordReaderTooLarge(t *testing.T) {
+	var stream bytes.Buffer
+	WriteRecord(&stream, make([]byte, MaxFragmentSize+1))
+	WriteRecord(&stream, []byte{1, 2, 3, 4})
+	WriteRecord(&stream, make([]byte, 2*MaxFragmentSize))
+
+	rr := NewRecordReader(&stream, MaxFragmentSize+1)
+	assert.Nil(t, rr.Next())
+	assert.Nil(t, rr.Next())
+	data, err := io.ReadAll(rr)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 4}, data)
+
+	// The limit is hit while reading the second fragment
+	assert.Nil(t, rr.Next())
+	_, err = io.ReadAll(rr)
+	assert.Equal(t, ErrorRecordTooLarge, err)
+	assert.Equal(t, io.EOF, rr.Next())
+
+	// Truncated stream
+	stream.Reset()
+	WriteRecord(&stream, []byte{1, 2, 3, 4})
+	stream.Truncate(6)
+	assert.Nil(t, rr.Next())
+	_, err = io.ReadAll(rr)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
@@ -0,0 +1,392 @@
+package sunrpc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Versions and procedures of the rpcbind protocol (RFC 1833), which is served by the same
+// program as the portmapper.
+const (
+	RpcbindVersion3 = 3
+	RpcbindVersion4 = 4
+
+	RpcbindProcSet         = 1
+	RpcbindProcUnset       = 2
+	RpcbindProcGetAddr     = 3
+	RpcbindProcDump        = 4
+	RpcbindProcGetTime     = 6
+	RpcbindProcGetVersAddr = 9  // version 4 only
+	RpcbindProcGetAddrList = 11 // version 4 only
+	RpcbindProcGetStat     = 12 // version 4 only
+)
+
+// RpcbindStatHighProc is the number of procedures for which rpcbind collects statistics.
+const RpcbindStatHighProc = 13
+
+// RpcbindMapping is a service registration, as handled by rpcbind: the address is a universal
+// address (see AddrToUaddr) whose format depends on the netid.
+type RpcbindMapping struct {
+	Program uint32
+	Version uint32
+	Netid   string
+	Addr    string
+	Owner   string
+}
+
+// RpcbindEntry is an address where a service is reachable, as returned by RpcbindGetAddrList.
+type RpcbindEntry struct {
+	Addr        string // universal address
+	Netid       string
+	Semantics   uint32 // transport semantics (eg: 1 for datagram, 3 for ordered stream)
+	ProtoFamily string
+	Proto       string
+}
+
+// RpcbindAddrStat counts the address lookups for a program version.
+type RpcbindAddrStat struct {
+	Program uint32
+	Version uint32
+	Success int32
+	Failure int32
+	Netid   string
+}
+
+// RpcbindRmtcallStat counts the indirect calls for a procedure.
+type RpcbindRmtcallStat struct {
+	Program   uint32
+	Version   uint32
+	Procedure uint32
+	Success   int32
+	Failure   int32
+	Indirect  int32
+	Netid     string
+}
+
+// RpcbindStat holds the statistics collected by rpcbind for one version of the protocol.
+type RpcbindStat struct {
+	Info    [RpcbindStatHighProc]int32 // calls received, by procedure
+	Set     int32
+	Unset   int32
+	Addr    []RpcbindAddrStat
+	Rmtcall []RpcbindRmtcallStat
+}
+
+// rpcbList is the XDR linked list of mappings returned by RPCBPROC_DUMP.
+type rpcbList struct {
+	Mapping RpcbindMapping
+	Next    *rpcbList `xdr:"optional"`
+}
+
+type rpcbDumpReply struct {
+	List *rpcbList `xdr:"optional"`
+}
+
+// rpcbEntryList is the XDR linked list of entries returned by RPCBPROC_GETADDRLIST.
+type rpcbEntryList struct {
+	Entry RpcbindEntry
+	Next  *rpcbEntryList `xdr:"optional"`
+}
+
+type rpcbEntryListReply struct {
+	List *rpcbEntryList `xdr:"optional"`
+}
+
+type rpcbsAddrList struct {
+	Stat RpcbindAddrStat
+	Next *rpcbsAddrList `xdr:"optional"`
+}
+
+type rpcbsRmtcallList struct {
+	Stat RpcbindRmtcallStat
+	Next *rpcbsRmtcallList `xdr:"optional"`
+}
+
+type rpcbStat struct {
+	Info    [RpcbindStatHighProc]int32
+	Set     int32
+	Unset   int32
+	Addr    *rpcbsAddrList    `xdr:"optional"`
+	Rmtcall *rpcbsRmtcallList `xdr:"optional"`
+}
+
+// rpcbindCall performs a call to rpcbind using version 4 of the protocol, falling back to
+// version 3 for the procedures that also exist there.
+func (p *Portmapper) rpcbindCall(proc uint32, args, reply interface{}) error {
+	err := p.client.CallProgram(PortmapperProgram, RpcbindVersion4, proc, args, reply)
+	if e, ok := err.(*ErrProgMismatch); ok && proc <= RpcbindProcGetTime && e.High >= RpcbindVersion3 {
+		err = p.client.CallProgram(PortmapperProgram, RpcbindVersion3, proc, args, reply)
+	}
+	return err
+}
+
+// RpcbindSet registers an RPC service listening on addr with the rpcbind server. Unlike Set, the
+// address can be an IPv6 or a Unix socket address.
+func (p *Portmapper) RpcbindSet(program uint32, version uint32, addr net.Addr) error {
+	netid, uaddr, err := AddrToUaddr(addr)
+	if err != nil {
+		return err
+	}
+
+	mapping := RpcbindMapping{
+		Program: program,
+		Version: version,
+		Netid:   netid,
+		Addr:    uaddr,
+		Owner:   strconv.Itoa(os.Getuid()),
+	}
+
+	var ok bool
+	if err := p.rpcbindCall(RpcbindProcSet, &mapping, &ok); err != nil {
+		return fmt.Errorf("cannot register to rpcbind server: %w", err)
+	}
+
+	if !ok {
+		return ErrorPortmapperServiceExists
+	}
+
+	return nil
+}
+
+// RpcbindUnset removes the registration of an RPC service for the specified netid, or for all
+// netids if netid is empty.
+func (p *Portmapper) RpcbindUnset(program uint32, version uint32, netid string) error {
+	mapping := RpcbindMapping{
+		Program: program,
+		Version: version,
+		Netid:   netid,
+		Owner:   strconv.Itoa(os.Getuid()),
+	}
+
+	var ok bool
+	if err := p.rpcbindCall(RpcbindProcUnset, &mapping, &ok); err != nil {
+		return fmt.Errorf("cannot deregister from rpcbind server: %w", err)
+	}
+
+	if !ok {
+		return ErrorPortmapperServiceDoesntExist
+	}
+
+	return nil
+}
+
+// RpcbindGetAddr returns the universal address of an RPC service for the specified netid, or
+// an empty string if the service is not registered.
+func (p *Portmapper) RpcbindGetAddr(program uint32, version uint32, netid string) (string, error) {
+	return p.rpcbindGetAddr(RpcbindProcGetAddr, program, version, netid)
+}
+
+// RpcbindGetVersAddr is like RpcbindGetAddr, but only returns an address if the exact version
+// of the program is registered.
+func (p *Portmapper) RpcbindGetVersAddr(program uint32, version uint32, netid string) (string, error) {
+	return p.rpcbindGetAddr(RpcbindProcGetVersAddr, program, version, netid)
+}
+
+func (p *Portmapper) rpcbindGetAddr(proc uint32, program uint32, version uint32, netid string) (string, error) {
+	mapping := RpcbindMapping{
+		Program: program,
+		Version: version,
+		Netid:   netid,
+	}
+
+	var uaddr string
+	if err := p.rpcbindCall(proc, &mapping, &uaddr); err != nil {
+		return "", fmt.Errorf("cannot query rpcbind server: %w", err)
+	}
+
+	return uaddr, nil
+}
+
+// RpcbindDump returns all the services registered with the rpcbind server.
+func (p *Portmapper) RpcbindDump() ([]RpcbindMapping, error) {
+	var reply rpcbDumpReply
+	if err := p.rpcbindCall(RpcbindProcDump, nil, &reply); err != nil {
+		return nil, fmt.Errorf("cannot query rpcbind server: %w", err)
+	}
+
+	var mappings []RpcbindMapping
+	for l := reply.List; l != nil; l = l.Next {
+		mappings = append(mappings, l.Mapping)
+	}
+	return mappings, nil
+}
+
+// RpcbindGetTime returns the current time on the rpcbind server host.
+func (p *Portmapper) RpcbindGetTime() (time.Time, error) {
+	var secs uint32
+	if err := p.rpcbindCall(RpcbindProcGetTime, nil, &secs); err != nil {
+		return time.Time{}, fmt.Errorf("cannot query rpcbind server: %w", err)
+	}
+
+	return time.Unix(int64(secs), 0), nil
+}
+
+// RpcbindGetAddrList returns all the addresses of an RPC service for transports with the same
+// protocol family as netid.
+func (p *Portmapper) RpcbindGetAddrList(program uint32, version uint32, netid string) ([]RpcbindEntry, error) {
+	mapping := RpcbindMapping{
+		Program: program,
+		Version: version,
+		Netid:   netid,
+	}
+
+	var reply rpcbEntryListReply
+	if err := p.rpcbindCall(RpcbindProcGetAddrList, &mapping, &reply); err != nil {
+		return nil, fmt.Errorf("cannot query rpcbind server: %w", err)
+	}
+
+	var entries []RpcbindEntry
+	for l := reply.List; l != nil; l = l.Next {
+		entries = append(entries, l.Entry)
+	}
+	return entries, nil
+}
+
+// RpcbindGetStat returns the statistics collected by the rpcbind server, for versions 2, 3 and 4
+// of the protocol (in this order).
+func (p *Portmapper) RpcbindGetStat() ([3]RpcbindStat, error) {
+	var reply [3]rpcbStat
+	var stats [3]RpcbindStat
+
+	if err := p.rpcbindCall(RpcbindProcGetStat, nil, &reply); err != nil {
+		return stats, fmt.Errorf("cannot query rpcbind server: %w", err)
+	}
+
+	for i, r := range reply {
+		stats[i] = RpcbindStat{Info: r.Info, Set: r.Set, Unset: r.Unset}
+		for l := r.Addr; l != nil; l = l.Next {
+			stats[i].Addr = append(stats[i].Addr, l.Stat)
+		}
+		for l := r.Rmtcall; l != nil; l = l.Next {
+			stats[i].Rmtcall = append(stats[i].Rmtcall, l.Stat)
+		}
+	}
+	return stats, nil
+}
+
+// RpcbindSet registers an RPC service listening on addr with the rpcbind server running on the
+// current host. Unlike PortmapperSet, the address can be an IPv6 or a Unix socket address.
+func RpcbindSet(program uint32, version uint32, addr net.Addr) error {
+	PortmapperInit()
+	return DefaultPortmapper.RpcbindSet(program, version, addr)
+}
+
+// RpcbindUnset removes the registration of an RPC service for the specified netid, or for all
+// netids if netid is empty.
+func RpcbindUnset(program uint32, version uint32, netid string) error {
+	PortmapperInit()
+	return DefaultPortmapper.RpcbindUnset(program, version, netid)
+}
+
+// RpcbindGetAddr returns the universal address of an RPC service for the specified netid, or
+// an empty string if the service is not registered.
+func RpcbindGetAddr(program uint32, version uint32, netid string) (string, error) {
+	PortmapperInit()
+	return DefaultPortmapper.RpcbindGetAddr(program, version, netid)
+}
+
+// RpcbindGetVersAddr is like RpcbindGetAddr, but only returns an address if the exact version
+// of the program is registered.
+func RpcbindGetVersAddr(program uint32, version uint32, netid string) (string, error) {
+	PortmapperInit()
+	return DefaultPortmapper.RpcbindGetVersAddr(program, version, netid)
+}
+
+// RpcbindDump returns all the services registered with the rpcbind server.
+func RpcbindDump() ([]RpcbindMapping, error) {
+	PortmapperInit()
+	return DefaultPortmapper.RpcbindDump()
+}
+
+// RpcbindGetTime returns the current time on the rpcbind server host.
+func RpcbindGetTime() (time.Time, error) {
+	PortmapperInit()
+	return DefaultPortmapper.RpcbindGetTime()
+}
+
+// RpcbindGetAddrList returns all the addresses of an RPC service for transports with the same
+// protocol family as netid.
+func RpcbindGetAddrList(program uint32, version uint32, netid string) ([]RpcbindEntry, error) {
+	PortmapperInit()
+	return DefaultPortmapper.RpcbindGetAddrList(program, version, netid)
+}
+
+// RpcbindGetStat returns the statistics collected by the rpcbind server, for versions 2, 3 and 4
+// of the protocol (in this order).
+func RpcbindGetStat() ([3]RpcbindStat, error) {
+	PortmapperInit()
+	return DefaultPortmapper.RpcbindGetStat()
+}
+
+var errInvalidUaddr = errors.New("invalid universal address")
+
+// AddrToUaddr converts a TCP, UDP or Unix socket address to the netid and universal address
+// used by rpcbind (eg: "tcp" and "127.0.0.1.0.111", or "udp6" and "::1.0.111").
+func AddrToUaddr(addr net.Addr) (netid string, uaddr string, err error) {
+	var ip net.IP
+	var port int
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port, netid = a.IP, a.Port, "tcp"
+	case *net.UDPAddr:
+		ip, port, netid = a.IP, a.Port, "udp"
+	case *net.UnixAddr:
+		if a.Net != "unix" {
+			return "", "", fmt.Errorf("unsupported address type: %v", a.Net)
+		}
+		return "local", a.Name, nil
+	default:
+		return "", "", fmt.Errorf("unsupported address type: %v", addr.Network())
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else if ip == nil {
+		ip = net.IPv4zero
+	} else {
+		netid += "6"
+	}
+
+	return netid, fmt.Sprintf("%s.%d.%d", ip, port>>8, port&0xff), nil
+}
+
+// UaddrToAddr converts a universal address for the specified netid (eg: "tcp", "udp6" or
+// "local") to a socket address.
+func UaddrToAddr(netid string, uaddr string) (net.Addr, error) {
+	switch netid {
+	case "local", "unix":
+		return &net.UnixAddr{Name: uaddr, Net: "unix"}, nil
+	case "tcp", "tcp6", "udp", "udp6":
+	default:
+		return nil, fmt.Errorf("unsupported netid: %v", netid)
+	}
+
+	// The port is encoded in the last two dot-separated fields
+	hi := strings.LastIndexByte(uaddr, '.')
+	if hi < 0 {
+		return nil, errInvalidUaddr
+	}
+	lo := strings.LastIndexByte(uaddr[:hi], '.')
+	if lo < 0 {
+		return nil, errInvalidUaddr
+	}
+
+	p1, err1 := strconv.ParseUint(uaddr[lo+1:hi], 10, 8)
+	p2, err2 := strconv.ParseUint(uaddr[hi+1:], 10, 8)
+	ip := net.ParseIP(uaddr[:lo])
+	if err1 != nil || err2 != nil || ip == nil {
+		return nil, errInvalidUaddr
+	}
+	port := int(p1<<8 | p2)
+
+	if strings.HasPrefix(netid, "tcp") {
+		return &net.TCPAddr{IP: ip, Port: port}, nil
+	}
+	return &net.UDPAddr{IP: ip, Port: port}, nil
+}
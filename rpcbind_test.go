@@ -0,0 +1,316 @@
+package sunrpc
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/rasky/go-xdr/xdr2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUaddr(t *testing.T) {
+	tests := []struct {
+		addr  net.Addr
+		netid string
+		uaddr string
+	}{
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 111}, "tcp", "127.0.0.1.0.111"},
+		{&net.UDPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 2049}, "udp", "10.1.2.3.8.1"},
+		{&net.TCPAddr{IP: net.IPv6loopback, Port: 65535}, "tcp6", "::1.255.255"},
+		{&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 20048}, "udp6", "fe80::1.78.80"},
+		{&net.UnixAddr{Name: "/var/run/rpcbind.sock", Net: "unix"}, "local", "/var/run/rpcbind.sock"},
+	}
+
+	for _, test := range tests {
+		netid, uaddr, err := AddrToUaddr(test.addr)
+		assert.Nil(t, err)
+		assert.Equal(t, test.netid, netid)
+		assert.Equal(t, test.uaddr, uaddr)
+
+		addr, err := UaddrToAddr(netid, uaddr)
+		assert.Nil(t, err)
+		assert.Equal(t, test.addr.String(), addr.String())
+		assert.Equal(t, test.addr.Network(), addr.Network())
+	}
+
+	_, uaddr, err := AddrToUaddr(&net.TCPAddr{Port: 800})
+	assert.Nil(t, err)
+	assert.Equal(t, "0.0.0.0.3.32", uaddr)
+
+	_, _, err = AddrToUaddr(&net.IPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NotNil(t, err)
+
+	for _, uaddr := range []string{"", "127.0.0.1", "127.0.0.1.0", "127.0.0.1.256.1", "foo.0.111"} {
+		_, err := UaddrToAddr("tcp", uaddr)
+		assert.NotNil(t, err, uaddr)
+	}
+	_, err = UaddrToAddr("sctp", "127.0.0.1.0.111")
+	assert.NotNil(t, err)
+}
+
+func TestRpcbindDumpDecode(t *testing.T) {
+	mappings := []RpcbindMapping{
+		{Program: 100000, Version: 4, Netid: "tcp6", Addr: "::.0.111", Owner: "superuser"},
+		{Program: 100003, Version: 3, Netid: "udp", Addr: "0.0.0.0.8.1", Owner: "0"},
+	}
+
+	var buf bytes.Buffer
+	for _, m := range mappings {
+		xdr.Marshal(&buf, true)
+		xdr.Marshal(&buf, &m)
+	}
+	xdr.Marshal(&buf, false)
+
+	var reply rpcbDumpReply
+	_, err := xdr.Unmarshal(&buf, &reply)
+	assert.Nil(t, err)
+	assert.Equal(t, mappings[0], reply.List.Mapping)
+	assert.Equal(t, mappings[1], reply.List.Next.Mapping)
+	assert.Nil(t, reply.List.Next.Next)
+}
+
+// fakeRpcbind is an in-process rpcbind server, speaking the specified versions of the protocol
+// (along with the NULL procedure of version 2, used by clients to ping the server).
+type fakeRpcbind struct {
+	mu       sync.Mutex
+	mappings []RpcbindMapping
+	versions []uint32 // protocol version of each call received
+}
+
+func startFakeRpcbind(t *testing.T, versions ...uint32) (*fakeRpcbind, *Portmapper) {
+	f := &fakeRpcbind{}
+
+	d := NewDispatcher()
+	d.Register(PortmapperProgram, PortmapperVersion, 0, func(arg struct{}, reply *struct{}) error { return nil })
+	for _, v := range versions {
+		d.Register(PortmapperProgram, v, 0, func(arg struct{}, reply *struct{}) error { return nil })
+		d.Register(PortmapperProgram, v, RpcbindProcSet, f.set)
+		d.Register(PortmapperProgram, v, RpcbindProcUnset, f.unset)
+		d.Register(PortmapperProgram, v, RpcbindProcGetAddr, f.getaddr)
+		d.Register(PortmapperProgram, v, RpcbindProcDump, f.dump)
+		d.Register(PortmapperProgram, v, RpcbindProcGetTime, f.gettime)
+		if v == RpcbindVersion4 {
+			d.Register(PortmapperProgram, v, RpcbindProcGetVersAddr, f.getaddr)
+			d.Register(PortmapperProgram, v, RpcbindProcGetAddrList, f.getaddrlist)
+			d.Register(PortmapperProgram, v, RpcbindProcGetStat, f.getstat)
+		}
+	}
+
+	srv := NewTCPServerWithDispatcher(d)
+	srv.SetConfig(&ServerConfig{Portmapper: PortmapperNone})
+	if err := srv.Serve("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+
+	pmap := NewPortmapper(srv.Addr().String(), &ClientConfig{Transport: ClientTransportTcpOnly})
+	t.Cleanup(pmap.Close)
+	return f, pmap
+}
+
+func (f *fakeRpcbind) record(cc *CallContext) {
+	f.mu.Lock()
+	f.versions = append(f.versions, cc.Version)
+	f.mu.Unlock()
+}
+
+func (f *fakeRpcbind) lastVersion() uint32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.versions[len(f.versions)-1]
+}
+
+func (f *fakeRpcbind) set(cc *CallContext, arg RpcbindMapping, reply *bool) error {
+	f.record(cc)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, m := range f.mappings {
+		if m.Program == arg.Program && m.Version == arg.Version && m.Netid == arg.Netid {
+			return nil
+		}
+	}
+	f.mappings = append(f.mappings, arg)
+	*reply = true
+	return nil
+}
+
+func (f *fakeRpcbind) unset(cc *CallContext, arg RpcbindMapping, reply *bool) error {
+	f.record(cc)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	mappings := f.mappings[:0]
+	for _, m := range f.mappings {
+		if m.Program == arg.Program && m.Version == arg.Version && (arg.Netid == "" || m.Netid == arg.Netid) {
+			*reply = true
+			continue
+		}
+		mappings = append(mappings, m)
+	}
+	f.mappings = mappings
+	return nil
+}
+
+func (f *fakeRpcbind) getaddr(cc *CallContext, arg RpcbindMapping, reply *string) error {
+	f.record(cc)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, m := range f.mappings {
+		if m.Program == arg.Program && m.Version == arg.Version && m.Netid == arg.Netid {
+			*reply = m.Addr
+		}
+	}
+	return nil
+}
+
+func (f *fakeRpcbind) dump(cc *CallContext, arg struct{}, reply *rpcbDumpReply) error {
+	f.record(cc)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := len(f.mappings) - 1; i >= 0; i-- {
+		reply.List = &rpcbList{Mapping: f.mappings[i], Next: reply.List}
+	}
+	return nil
+}
+
+func (f *fakeRpcbind) gettime(cc *CallContext, arg struct{}, reply *uint32) error {
+	f.record(cc)
+	*reply = 1500000000
+	return nil
+}
+
+func (f *fakeRpcbind) getaddrlist(cc *CallContext, arg RpcbindMapping, reply *rpcbEntryListReply) error {
+	f.record(cc)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i := len(f.mappings) - 1; i >= 0; i-- {
+		m := f.mappings[i]
+		if m.Program == arg.Program && m.Version == arg.Version {
+			entry := RpcbindEntry{Addr: m.Addr, Netid: m.Netid, Semantics: 3, ProtoFamily: "inet", Proto: "tcp"}
+			reply.List = &rpcbEntryList{Entry: entry, Next: reply.List}
+		}
+	}
+	return nil
+}
+
+func (f *fakeRpcbind) getstat(cc *CallContext, arg struct{}, reply *[3]rpcbStat) error {
+	f.record(cc)
+	for i := range reply {
+		reply[i].Info[RpcbindProcGetAddr] = int32(i + 1)
+		reply[i].Set = int32(10 * (i + 1))
+	}
+	reply[2].Addr = &rpcbsAddrList{
+		Stat: RpcbindAddrStat{Program: 1234, Version: 1, Success: 2, Failure: 1, Netid: "tcp"},
+		Next: &rpcbsAddrList{Stat: RpcbindAddrStat{Program: 1234, Version: 2, Success: 1, Netid: "udp"}},
+	}
+	reply[1].Rmtcall = &rpcbsRmtcallList{
+		Stat: RpcbindRmtcallStat{Program: 1234, Version: 1, Procedure: 3, Success: 1, Indirect: 1, Netid: "udp"},
+	}
+	return nil
+}
+
+func TestRpcbind(t *testing.T) {
+	f, pmap := startFakeRpcbind(t, RpcbindVersion3, RpcbindVersion4)
+
+	tcpAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2049}
+	udpAddr := &net.UDPAddr{IP: net.IPv6loopback, Port: 2049}
+	assert.Nil(t, pmap.RpcbindSet(1234, 1, tcpAddr))
+	assert.Equal(t, uint32(RpcbindVersion4), f.lastVersion())
+	assert.Equal(t, ErrorPortmapperServiceExists, pmap.RpcbindSet(1234, 1, tcpAddr))
+	assert.Nil(t, pmap.RpcbindSet(1234, 1, udpAddr))
+
+	uaddr, err := pmap.RpcbindGetAddr(1234, 1, "tcp")
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1.8.1", uaddr)
+	uaddr, err = pmap.RpcbindGetVersAddr(1234, 1, "udp6")
+	assert.Nil(t, err)
+	assert.Equal(t, "::1.8.1", uaddr)
+	uaddr, err = pmap.RpcbindGetAddr(1234, 2, "tcp")
+	assert.Nil(t, err)
+	assert.Equal(t, "", uaddr)
+
+	mappings, err := pmap.RpcbindDump()
+	assert.Nil(t, err)
+	if assert.Len(t, mappings, 2) {
+		assert.Equal(t, "tcp", mappings[0].Netid)
+		assert.Equal(t, "udp6", mappings[1].Netid)
+	}
+
+	entries, err := pmap.RpcbindGetAddrList(1234, 1, "tcp")
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "127.0.0.1.8.1", entries[0].Addr)
+		assert.Equal(t, "::1.8.1", entries[1].Addr)
+	}
+
+	now, err := pmap.RpcbindGetTime()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1500000000), now.Unix())
+
+	stats, err := pmap.RpcbindGetStat()
+	assert.Nil(t, err)
+	for i, stat := range stats {
+		assert.Equal(t, int32(i+1), stat.Info[RpcbindProcGetAddr])
+		assert.Equal(t, int32(10*(i+1)), stat.Set)
+	}
+	assert.Nil(t, stats[0].Addr)
+	assert.Equal(t, []RpcbindRmtcallStat{
+		{Program: 1234, Version: 1, Procedure: 3, Success: 1, Indirect: 1, Netid: "udp"},
+	}, stats[1].Rmtcall)
+	assert.Equal(t, []RpcbindAddrStat{
+		{Program: 1234, Version: 1, Success: 2, Failure: 1, Netid: "tcp"},
+		{Program: 1234, Version: 2, Success: 1, Netid: "udp"},
+	}, stats[2].Addr)
+
+	// Unset only removes the specified netid
+	assert.Nil(t, pmap.RpcbindUnset(1234, 1, "tcp"))
+	assert.Equal(t, ErrorPortmapperServiceDoesntExist, pmap.RpcbindUnset(1234, 1, "tcp"))
+	uaddr, err = pmap.RpcbindGetAddr(1234, 1, "udp6")
+	assert.Nil(t, err)
+	assert.Equal(t, "::1.8.1", uaddr)
+	assert.Nil(t, pmap.RpcbindUnset(1234, 1, ""))
+	mappings, err = pmap.RpcbindDump()
+	assert.Nil(t, err)
+	assert.Empty(t, mappings)
+}
+
+func TestRpcbindVersion3Fallback(t *testing.T) {
+	f, pmap := startFakeRpcbind(t, RpcbindVersion3)
+
+	tcpAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2049}
+	assert.Nil(t, pmap.RpcbindSet(1234, 1, tcpAddr))
+	assert.Equal(t, uint32(RpcbindVersion3), f.lastVersion())
+
+	uaddr, err := pmap.RpcbindGetAddr(1234, 1, "tcp")
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1.8.1", uaddr)
+
+	mappings, err := pmap.RpcbindDump()
+	assert.Nil(t, err)
+	assert.Len(t, mappings, 1)
+
+	now, err := pmap.RpcbindGetTime()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1500000000), now.Unix())
+
+	assert.Nil(t, pmap.RpcbindUnset(1234, 1, "tcp"))
+	assert.Equal(t, uint32(RpcbindVersion3), f.lastVersion())
+
+	// Procedures only defined by version 4 are not retried, and the error of the server can
+	// be inspected
+	var mismatch *ErrProgMismatch
+	_, err = pmap.RpcbindGetVersAddr(1234, 1, "tcp")
+	assert.True(t, errors.As(err, &mismatch), "%v", err)
+	_, err = pmap.RpcbindGetAddrList(1234, 1, "tcp")
+	assert.True(t, errors.As(err, &mismatch), "%v", err)
+	_, err = pmap.RpcbindGetStat()
+	assert.True(t, errors.As(err, &mismatch), "%v", err)
+	assert.Equal(t, uint32(RpcbindVersion3), f.lastVersion())
+}
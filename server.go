@@ -2,47 +2,313 @@ package sunrpc
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
 	"strconv"
+	"sync"
+	"time"
 
 	"gopkg.in/Sirupsen/logrus.v0"
 )
 
+// ErrorServerClosed is returned by Serve after the server has been shut down or closed.
+var ErrorServerClosed = errors.New("RPC server closed")
+
+// ErrorNoDefaultProgram is returned by Register when the server was created with an empty
+// Dispatcher: procedures must be registered through the Dispatcher instead.
+var ErrorNoDefaultProgram = errors.New("RPC server has no default program")
+
+// PortmapperMode selects how a server registers to the portmapper when it starts serving.
+type PortmapperMode int
+
+const (
+	PortmapperRequired   PortmapperMode = iota // Serve fails if the registration fails (default)
+	PortmapperBestEffort                       // registration errors are logged, and ignored
+	PortmapperNone                             // the server is not registered
+	PortmapperBackground                       // registration is retried in background until it succeeds
+)
+
+// ServerConfig holds the configuration of a server.
+type ServerConfig struct {
+	Portmapper      PortmapperMode // portmapper registration mode (default: PortmapperRequired)
+	PortmapperRetry time.Duration  // interval between registration attempts in background (default: 5s)
+
+	// PortmapperClient is the portmapper the server registers to (default: DefaultPortmapper).
+	PortmapperClient *Portmapper
+
+	// MaxMessageSize is the maximum size of a call received over TCP (default: 32 KB); larger
+	// calls are rejected with GARBAGE_ARGS. Over UDP, calls are limited to MaxUdpSize.
+	MaxMessageSize int
+}
+
+// CallContext describes the call being handled. Handlers receive it if they take it as first
+// argument:
+//
+//	func (t *T) MethodName(ctx *CallContext, argType T1, replyType *T2) error
+//
+// The embedded context is cancelled when the server is closed (by Close, or by Shutdown when
+// its context expires). Client disconnections are not detected while the handler runs.
+type CallContext struct {
+	context.Context
+
+	RemoteAddr net.Addr
+	Transport  string // network of the server (eg: "tcp", "udp" or "unix")
+	Xid        uint32
+	Program    uint32
+	Version    uint32
+	Procedure  uint32
+	Cred       interface{} // credentials, as decoded by the Authenticator of their flavor (if any)
+	RawCred    OpaqueAuth  // credentials, as received (eg: AUTH_SHORT)
+}
+
 type server struct {
-	program    uint32
-	version    uint32
-	procedures map[uint32]interface{}
-	procnames  map[uint32]string
+	program    uint32 // program bound by Register and RegisterWithName
+	version    uint32 // version bound by Register and RegisterWithName
+	hasProgram bool   // whether program and version are set
+	dispatcher *Dispatcher
 	log        *logrus.Entry
 	authFun    func(proc uint32, cred interface{}) bool
+	shortMu    sync.Mutex
+	shortCache *authShortCache // guarded by shortMu, as it can be replaced while serving
+	cfg        ServerConfig
+	ctx        context.Context // base context of the calls, cancelled when the server is closed
+	cancel     context.CancelFunc
+
+	pmapMu     sync.Mutex
+	pmapProt   PortmapperProtocol // protocol the program versions are registered for
+	registered []ProgramVersion   // program versions registered to the portmapper
+	pmapStop   chan struct{}      // closed to stop the background registration
+	pmapDone   chan struct{}      // closed when the background registration exits
 }
 
 func newServer(program uint32, version uint32, f logrus.Fields) server {
+	d := NewDispatcher()
+	d.table(program, version)
+	return newServerWithDispatcher(d, f)
+}
+
+func newServerWithDispatcher(d *Dispatcher, f logrus.Fields) server {
+	var program ProgramVersion
+	progs := d.Programs()
+	if len(progs) > 0 {
+		program = progs[0]
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return server{
-		program:    program,
-		version:    version,
-		procedures: make(map[uint32]interface{}),
-		procnames:  make(map[uint32]string),
+		ctx:        ctx,
+		cancel:     cancel,
+		program:    program.Program,
+		version:    program.Version,
+		hasProgram: len(progs) > 0,
+		dispatcher: d,
 		log:        logrus.WithField("package", "sunrpc").WithFields(f),
+		cfg:        ServerConfig{PortmapperRetry: 5 * time.Second, MaxMessageSize: DefaultMaxRecordSize},
+	}
+}
+
+// SetConfig changes the configuration of the server; it must be called before Serve.
+func (server *server) SetConfig(cfg *ServerConfig) {
+	server.cfg = *cfg
+
+	var zz time.Duration
+	if server.cfg.PortmapperRetry == zz {
+		server.cfg.PortmapperRetry = 5 * time.Second
+	}
+	if server.cfg.MaxMessageSize == 0 {
+		server.cfg.MaxMessageSize = DefaultMaxRecordSize
 	}
 }
 
 // Register binds a new RPC procedure ID to a function.
-func (server *server) Register(proc uint32, rcvr interface{}) {
-	server.procedures[proc] = rcvr
+//
+// For servers created with a Dispatcher, the procedure is bound to the first program
+// version registered in the Dispatcher at the time of creation; if there was none, it fails
+// with ErrorNoDefaultProgram.
+func (server *server) Register(proc uint32, rcvr interface{}) error {
+	if !server.hasProgram {
+		return ErrorNoDefaultProgram
+	}
+	return server.dispatcher.Register(server.program, server.version, proc, rcvr)
 }
 
-func (server *server) RegisterWithName(proc uint32, rcvr interface{}, name string) {
-	server.procedures[proc] = rcvr
-	server.procnames[proc] = name
+func (server *server) RegisterWithName(proc uint32, rcvr interface{}, name string) error {
+	if !server.hasProgram {
+		return ErrorNoDefaultProgram
+	}
+	return server.dispatcher.RegisterWithName(server.program, server.version, proc, rcvr, name)
+}
+
+// RegisterService binds procedures to the methods of rcvr; see Dispatcher.RegisterService.
+func (server *server) RegisterService(rcvr interface{}) (map[uint32]string, error) {
+	if !server.hasProgram {
+		return nil, ErrorNoDefaultProgram
+	}
+	return server.dispatcher.RegisterService(server.program, server.version, rcvr)
 }
 
+// registerToPortmapper registers all the program versions served by the server, according to
+// the configured PortmapperMode.
 func (server *server) registerToPortmapper(prot PortmapperProtocol, port int) error {
+	switch server.cfg.Portmapper {
+	case PortmapperNone:
+		return nil
+
+	case PortmapperBestEffort:
+		if err := server.registerAll(prot, port); err != nil {
+			server.log.WithField("err", err).Warn("Cannot register to portmapper")
+		}
+		return nil
+
+	case PortmapperBackground:
+		if err := server.registerAll(prot, port); err != nil {
+			server.log.WithField("err", err).Info("Cannot register to portmapper, retrying in background")
+
+			server.pmapMu.Lock()
+			server.pmapStop = make(chan struct{})
+			server.pmapDone = make(chan struct{})
+			go server.registerInBackground(prot, port, server.pmapStop, server.pmapDone)
+			server.pmapMu.Unlock()
+		}
+		return nil
+
+	default:
+		if err := server.registerAll(prot, port); err != nil {
+			server.unregisterFromPortmapper()
+			return err
+		}
+		return nil
+	}
+}
+
+// registerAll registers the program versions that are not registered yet.
+func (server *server) registerAll(prot PortmapperProtocol, port int) error {
+	pmap := server.portmapper()
+
 	// Check if the portmapper server is available, to return a proper high-level error
 	// rather than a generic socket error.
-	if !PortmapperAvailable() {
+	if !pmap.Available() {
 		return ErrorPortmapperNotFound
 	}
 
+	for _, pv := range server.dispatcher.Programs() {
+		if server.isRegistered(pv) {
+			continue
+		}
+
+		if err := registerProgramToPortmapper(pmap, pv.Program, pv.Version, prot, port); err != nil {
+			return err
+		}
+
+		server.pmapMu.Lock()
+		server.pmapProt = prot
+		server.registered = append(server.registered, pv)
+		server.pmapMu.Unlock()
+	}
+	return nil
+}
+
+func (server *server) isRegistered(pv ProgramVersion) bool {
+	server.pmapMu.Lock()
+	defer server.pmapMu.Unlock()
+
+	for _, r := range server.registered {
+		if r == pv {
+			return true
+		}
+	}
+	return false
+}
+
+func (server *server) registerInBackground(prot PortmapperProtocol, port int, stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(server.cfg.PortmapperRetry)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := server.registerAll(prot, port); err == nil {
+			server.log.Info("Registered to portmapper")
+			return
+		}
+	}
+}
+
+// unregisterFromPortmapper removes the registrations performed by registerToPortmapper, leaving
+// alone those of other protocols (eg: of a UDP server of the same program, still running).
+func (server *server) unregisterFromPortmapper() error {
+	// Stop the background registration first, so that nothing is registered afterwards
+	server.pmapMu.Lock()
+	stop, done := server.pmapStop, server.pmapDone
+	server.pmapStop, server.pmapDone = nil, nil
+	server.pmapMu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+
+	server.pmapMu.Lock()
+	prot, registered := server.pmapProt, server.registered
+	server.registered = nil
+	server.pmapMu.Unlock()
+
+	var firstErr error
+	for _, pv := range registered {
+		err := unregisterProgramFromPortmapper(server.portmapper(), pv.Program, pv.Version, prot)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// unregisterProgramFromPortmapper removes the mapping of a program version for the specified
+// protocol. Version 2 of the portmapper protocol can only remove the mappings of all protocols
+// at once, so with old portmappers the mappings of other protocols are registered again.
+func unregisterProgramFromPortmapper(pmap *Portmapper, program, version uint32, prot PortmapperProtocol) error {
+	err := pmap.RpcbindUnset(program, version, prot.String())
+	var mismatch *ErrProgMismatch
+	if errors.As(err, &mismatch) {
+		other := Udp
+		if prot == Udp {
+			other = Tcp
+		}
+		var otherPort uint32
+		if otherPort, err = pmap.Get(program, version, other); err != nil {
+			return err
+		}
+
+		err = pmap.Unset(program, version)
+		if err == nil && otherPort != 0 {
+			err = pmap.Set(program, version, other, otherPort)
+		}
+	}
+
+	if err == ErrorPortmapperServiceDoesntExist {
+		return nil
+	}
+	return err
+}
+
+// portmapper returns the portmapper the server registers to.
+func (server *server) portmapper() *Portmapper {
+	if server.cfg.PortmapperClient != nil {
+		return server.cfg.PortmapperClient
+	}
+	PortmapperInit()
+	return DefaultPortmapper
+}
+
+func registerProgramToPortmapper(pmap *Portmapper, program, version uint32, prot PortmapperProtocol, port int) error {
 	// First check if there's a mapping already. We do this because Linux rpcbind server (but not OSX)
 	// is smart enough to use this call to also verify whether a registered service
 	// is still alive (listening on that port), and if it doesn't, it returns zero.
@@ -51,13 +317,13 @@ func (server *server) registerToPortmapper(prot PortmapperProtocol, port int) er
 	// this would allow the user to run the application more than one time with different ports,
 	// without getting errors, as the call to PortmapperGet() would effectively deregister the
 	// previous registration automatically.
-	getport, err := PortmapperGet(server.program, server.version, prot)
+	getport, err := pmap.Get(program, version, prot)
 	switch {
 	case err != nil:
 		return err
 	case getport == 0:
 		// no service found, we need to register again
-		return PortmapperSet(server.program, server.version, prot, uint32(port))
+		return pmap.Set(program, version, prot, uint32(port))
 	case getport != uint32(port):
 		// found a service with a different port, returns error
 		return ErrorPortmapperServiceExists
@@ -67,83 +333,179 @@ func (server *server) registerToPortmapper(prot PortmapperProtocol, port int) er
 	}
 }
 
-func (s *server) handleRecord(record []byte) (bytes.Buffer, error) {
-
+// handleRecord handles a call received as a whole (eg: in a UDP datagram), and returns its reply.
+func (s *server) handleRecord(cc CallContext, record []byte) (bytes.Buffer, error) {
 	var reply bytes.Buffer
-	r := bytes.NewReader(record)
+	err := s.handleStream(cc, bytes.NewReader(record), &reply, len(record))
+	return reply, err
+}
 
+// handleStream handles a call read from r, and writes its reply to w. The arguments are decoded
+// while they are read; maxSize is the maximum size of the call, which bounds the size of each
+// variable-length item. cc describes the connection the call was received on, and is completed
+// with the details of the call. Nothing is written to w if the call must be dropped without a
+// reply.
+func (s *server) handleStream(cc CallContext, r io.Reader, w io.Writer, maxSize int) error {
+	// Calls that can't be parsed are dropped without a reply, as we can't even be sure that
+	// they were meant for us
 	call, err := ReadProcedureCall(r)
+	if rpcErr, ok := err.(*ErrRpcMismatch); ok {
+		s.log.WithField("was", call.Body.RPCVersion).Error("Mismatched RPC version")
+		return s.writeReplyMessageRpcMismatch(w, call.Header.Xid, rpcErr.Low, rpcErr.High)
+	}
 	if err != nil {
 		s.log.WithField("err", err).Error("Cannot read RPC Call message")
-		return reply, err
+		return err
 	}
 
-	if call.Body.Program != s.program {
+	cc.Xid = call.Header.Xid
+	cc.Program = call.Body.Program
+	cc.Version = call.Body.Version
+	cc.Procedure = call.Body.Procedure
+	cc.RawCred = call.Body.Cred
+
+	switch stat, low, high := s.dispatcher.checkProgram(call.Body.Program, call.Body.Version); stat {
+	case ProgUnavail:
 		s.log.WithFields(logrus.Fields{
-			"expected": s.program,
-			"was":      call.Body.Program,
-		}).Error("Mismatched program number")
+			"prog": call.Body.Program,
+		}).Error("Unavailable program")
 
-		err := s.WriteReplyMessage(&reply, call.Header.Xid, ProgUnavail, nil)
-		return reply, err
-	}
+		return s.WriteReplyMessage(w, call.Header.Xid, ProgUnavail, nil)
 
-	if call.Body.Version != s.version {
+	case ProgMismatch:
 		s.log.WithFields(logrus.Fields{
-			"expected": s.version,
-			"was":      call.Body.Version,
+			"low":  low,
+			"high": high,
+			"was":  call.Body.Version,
 		}).Error("Mismatched program version")
 
 		ret := ProgMismatchReply{
-			Low:  uint(s.version),
-			High: uint(s.version),
+			Low:  uint(low),
+			High: uint(high),
 		}
-		err := s.WriteReplyMessage(&reply, call.Header.Xid, ProgMismatch, &ret)
-		return reply, err
+		return s.WriteReplyMessage(w, call.Header.Xid, ProgMismatch, &ret)
 	}
 
-	// Handle authentication (if the user requested so)
-	if s.authFun != nil {
-		auth, err := call.Body.Cred.Decode()
-		if err != nil {
+	// Replace AUTH_SHORT credentials with the full credentials they were issued for. Handles
+	// we don't know about (or if we don't issue them at all) are rejected, so that the client
+	// sends its full credentials again.
+	s.shortMu.Lock()
+	shortCache := s.shortCache
+	s.shortMu.Unlock()
+	credAuth := call.Body.Cred
+	if credAuth.Flavor == AuthFlavorShort {
+		var found bool
+		if shortCache != nil {
+			credAuth, found = shortCache.resolve(credAuth.Body)
+		}
+		if !found {
+			s.log.Debug("rejecting unknown AUTH_SHORT credentials")
+			return s.WriteReplyMessageRejectedAuth(w, call.Header.Xid, AuthRejectedCred)
+		}
+	}
+
+	// Decode the credentials with the Authenticator registered for their flavor, and validate
+	// the call verifier. Credentials that can't be decoded are only an error if the user
+	// requested authentication.
+	verf := OpaqueAuth{Flavor: AuthFlavorNone}
+	auth, err := LookupAuthenticator(credAuth.Flavor)
+	var cred interface{}
+	if err == nil {
+		cred, err = auth.DecodeCred(credAuth.Body)
+	}
+	if err != nil {
+		if s.authFun != nil {
 			s.log.WithField("err", err).Error("cannot decode authentication")
-			err := s.WriteReplyMessageRejectedAuth(&reply, call.Header.Xid, AuthBadCred)
-			return reply, err
+			return s.WriteReplyMessageRejectedAuth(w, call.Header.Xid, AuthBadCred)
+		}
+	} else {
+		if err := auth.ValidateVerifier(cred, call.Body.Verf); err != nil {
+			s.log.WithField("err", err).Error("invalid authentication verifier")
+			return s.WriteReplyMessageRejectedAuth(w, call.Header.Xid, AuthBadVerf)
+		}
+
+		if verf, err = auth.Verifier(cred); err != nil {
+			s.log.WithField("err", err).Error("cannot create authentication verifier")
+			return s.writeReplyMessage(w, call.Header.Xid, verf, SystemErr, nil)
 		}
+	}
 
-		if !s.authFun(call.Body.Procedure, auth) {
-			s.log.WithFields(logrus.Fields{
-				"proc": strconv.Itoa(int(call.Body.Procedure)),
-				"prog": strconv.Itoa(int(call.Body.Program)),
-			}).Info("authentication rejected by user")
-			err := s.WriteReplyMessageRejectedAuth(&reply, call.Header.Xid, AuthBadCred)
-			return reply, err
+	// Issue an AUTH_SHORT handle for full AUTH_UNIX credentials, if requested
+	if shortCache != nil && call.Body.Cred.Flavor == AuthFlavorUnix && cred != nil {
+		handle, err := shortCache.issue(call.Body.Cred)
+		if err != nil {
+			s.log.WithField("err", err).Error("cannot issue AUTH_SHORT handle")
+		} else {
+			verf = OpaqueAuth{Flavor: AuthFlavorShort, Body: handle}
 		}
 	}
 
+	cc.Cred = cred
+
+	// Handle authentication (if the user requested so)
+	if s.authFun != nil && !s.authFun(call.Body.Procedure, cred) {
+		s.log.WithFields(logrus.Fields{
+			"proc": strconv.Itoa(int(call.Body.Procedure)),
+			"prog": strconv.Itoa(int(call.Body.Program)),
+		}).Info("authentication rejected by user")
+		return s.WriteReplyMessageRejectedAuth(w, call.Header.Xid, AuthBadCred)
+	}
+
 	// Resolve function type from function table
-	receiverFunc, found := s.procedures[call.Body.Procedure]
+	receiverFunc, procname, found := s.dispatcher.procedure(call.Body.Program, call.Body.Version, call.Body.Procedure)
 	if !found {
 		s.log.WithFields(logrus.Fields{
 			"proc": strconv.Itoa(int(call.Body.Procedure)),
 			"prog": strconv.Itoa(int(call.Body.Program)),
 		}).Error("Unsupported procedure call")
 
-		err := s.WriteReplyMessage(&reply, call.Header.Xid, ProcUnavail, nil)
-		return reply, err
+		return s.writeReplyMessage(w, call.Header.Xid, verf, ProcUnavail, nil)
 	}
 
 	s.log.WithFields(logrus.Fields{
 		"proc": strconv.Itoa(int(call.Body.Procedure)),
-		"name": s.procnames[call.Body.Procedure],
-	}).Debug("RPC ", s.procnames[call.Body.Procedure])
-	acceptType := Success
-	ret, err := s.callFunc(r, receiverFunc)
+		"name": procname,
+	}).Debug("RPC ", procname)
+	ret, err := s.callFunc(&cc, r, maxSize, receiverFunc)
+	if err == errNoReply {
+		s.log.Debug("Call dropped by the procedure")
+		return nil
+	}
 	if err != nil {
 		s.log.WithField("err", err).Error("Unable to perform procedure call")
-		acceptType = SystemErr
+		return s.writeErrorReply(w, call.Header.Xid, verf, rpcStatusOf(err))
 	}
 
-	err = s.WriteReplyMessage(&reply, call.Header.Xid, acceptType, ret)
-	return reply, err
+	return s.writeReplyMessage(w, call.Header.Xid, verf, Success, ret)
+}
+
+// errNoReply is returned by procedures to drop the call without a reply, as required by some
+// protocols (eg: failed PMAPPROC_CALLIT calls), or because they reply on their own.
+var errNoReply = errors.New("call dropped without reply")
+
+// writeErrorReply writes the reply to a call which failed with the specified status.
+func (s *server) writeErrorReply(w io.Writer, xid uint32, verf OpaqueAuth, status RPCStatusError) error {
+	if status.Type == Denied {
+		switch status.Reject {
+		case RpcMismatch:
+			return s.writeReplyMessageRpcMismatch(w, xid, status.Low, status.High)
+		case AuthError:
+			return s.WriteReplyMessageRejectedAuth(w, xid, status.Auth)
+		}
+		status = RPCStatusError{Type: Accepted, Accept: SystemErr}
+	}
+
+	switch status.Accept {
+	case Success:
+		// A successful reply would need results
+		return s.writeReplyMessage(w, xid, verf, SystemErr, nil)
+	case ProgMismatch:
+		ret := ProgMismatchReply{
+			Low:  uint(status.Low),
+			High: uint(status.High),
+		}
+		return s.writeReplyMessage(w, xid, verf, ProgMismatch, &ret)
+	default:
+		return s.writeReplyMessage(w, xid, verf, status.Accept, nil)
+	}
 }
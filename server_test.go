@@ -0,0 +1,547 @@
+package sunrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTCPServerShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	srv := NewTCPServer(1, 1).(*TCPServer)
+	srv.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	srv.Register(1, func(arg uint32, reply *uint32) error {
+		close(started)
+		<-release
+		*reply = arg + 1
+		return nil
+	})
+
+	addr := serveTCP(t, srv)
+
+	c := NewClient(addr, 1, 1, &ClientConfig{Transport: ClientTransportTcpOnly, Timeout: 5 * time.Second})
+	defer c.Close()
+
+	var reply uint32
+	callErr := make(chan error, 1)
+	go func() { callErr <- c.Call(1, uint32(41), &reply) }()
+	<-started
+
+	// Shutdown must wait for the in-flight call
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- srv.Shutdown(context.Background()) }()
+
+	select {
+	case <-shutdownErr:
+		t.Fatal("Shutdown returned before the in-flight call completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	assert.Nil(t, <-callErr)
+	assert.Equal(t, uint32(42), reply)
+	assert.Nil(t, <-shutdownErr)
+
+	// New connections are refused
+	_, err := net.Dial("tcp4", addr)
+	assert.NotNil(t, err)
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ErrorServerClosed, srv.serve(listener))
+}
+
+func TestTCPServerShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+
+	srv := NewTCPServer(1, 1).(*TCPServer)
+	srv.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	srv.Register(1, func(arg struct{}, reply *struct{}) error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	addr := serveTCP(t, srv)
+
+	c := NewClient(addr, 1, 1, &ClientConfig{Transport: ClientTransportTcpOnly, Timeout: 5 * time.Second})
+	defer c.Close()
+
+	callErr := make(chan error, 1)
+	go func() { callErr <- c.Call(1, struct{}{}, &struct{}{}) }()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, srv.Shutdown(ctx))
+
+	// The connection was forcibly closed, so the call fails
+	assert.NotNil(t, <-callErr)
+}
+
+func TestUDPServerShutdown(t *testing.T) {
+	srv := NewUDPServer(1, 1).(*UDPServer)
+	srv.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	srv.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg + 1
+		return nil
+	})
+
+	addr := serveUDP(t, srv)
+
+	c := NewClient(addr, 1, 1, &ClientConfig{Transport: ClientTransportUdpOnly, Timeout: time.Second})
+	defer c.Close()
+
+	var reply uint32
+	assert.Nil(t, c.Call(1, uint32(1), &reply))
+	assert.Equal(t, uint32(2), reply)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Nil(t, srv.Shutdown(ctx))
+
+	// The read loop exited and the socket is closed
+	<-srv.done
+	_, err := srv.conn.WriteTo([]byte{0}, srv.conn.LocalAddr())
+	assert.NotNil(t, err)
+}
+
+func TestUDPServerExternalClose(t *testing.T) {
+	srv := NewUDPServer(1, 1).(*UDPServer)
+	serveUDP(t, srv)
+
+	// The read loop stops, rather than spinning, when the socket is closed under its feet
+	srv.conn.Close()
+	select {
+	case <-srv.done:
+	case <-time.After(time.Second):
+		t.Fatal("read loop still running")
+	}
+}
+
+// serveTCP serves s on a random local port, without registering to the portmapper, until
+// the end of the test.
+func serveTCP(t *testing.T, s *TCPServer) string {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.serve(listener); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return listener.Addr().String()
+}
+
+// serveUDP is the UDP counterpart of serveTCP.
+func serveUDP(t *testing.T, s *UDPServer) string {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.serve(conn); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return conn.LocalAddr().String()
+}
+
+// callConn performs a call through the client on an already established connection.
+func callConn(t *testing.T, c *Client, conn net.Conn, udp bool, proc uint32, args, reply interface{}) error {
+	pcall, err := c.newCall(c.Program, c.Version, proc)
+	if err != nil {
+		return err
+	}
+	payload, err := encodeCall(pcall, args, udp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(payload); err != nil {
+		return err
+	}
+
+	if udp {
+		buf := make([]byte, MaxUdpSize)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		return c.readReply(bytes.NewReader(buf[:n]), pcall, reply)
+	}
+
+	record, err := ReadRecord(conn)
+	if err != nil {
+		return err
+	}
+	return c.readReply(record, pcall, reply)
+}
+
+func TestServeUnixSockets(t *testing.T) {
+	dir := t.TempDir()
+	c := NewClient("", 1, 1, nil)
+
+	double := func(arg uint32, reply *uint32) error {
+		*reply = arg * 2
+		return nil
+	}
+
+	// Stream socket
+	tsrv := NewTCPServer(1, 1).(*TCPServer)
+	tsrv.Register(1, double)
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "stream.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, tsrv.ServeListener(listener))
+	defer tsrv.Close()
+
+	conn, err := net.Dial("unix", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var reply uint32
+	assert.Nil(t, callConn(t, c, conn, false, 1, uint32(21), &reply))
+	assert.Equal(t, uint32(42), reply)
+
+	// Datagram socket
+	usrv := NewUDPServer(1, 1).(*UDPServer)
+	usrv.Register(1, double)
+
+	pconn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "dgram.sock"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, usrv.ServePacketConn(pconn))
+	defer usrv.Close()
+
+	// Datagram sockets need a bound local address to receive the reply
+	uconn, err := net.DialUnix("unixgram",
+		&net.UnixAddr{Name: filepath.Join(dir, "client.sock"), Net: "unixgram"},
+		pconn.LocalAddr().(*net.UnixAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uconn.Close()
+
+	assert.Nil(t, callConn(t, c, uconn, true, 1, uint32(50), &reply))
+	assert.Equal(t, uint32(100), reply)
+}
+
+func TestServerAddr(t *testing.T) {
+	tsrv := NewTCPServer(1, 1).(*TCPServer)
+	assert.Nil(t, tsrv.Addr())
+
+	assert.Equal(t, serveTCP(t, tsrv), tsrv.Addr().String())
+	assert.NotEqual(t, 0, tsrv.Addr().(*net.TCPAddr).Port)
+
+	usrv := NewUDPServer(1, 1).(*UDPServer)
+	assert.Nil(t, usrv.Addr())
+
+	assert.Equal(t, serveUDP(t, usrv), usrv.Addr().String())
+	assert.NotEqual(t, 0, usrv.Addr().(*net.UDPAddr).Port)
+}
+
+func TestServerPortmapperModes(t *testing.T) {
+	if PortmapperAvailable() {
+		t.Skip("a portmapper is running on this host")
+	}
+
+	for _, mode := range []PortmapperMode{PortmapperNone, PortmapperBestEffort, PortmapperBackground} {
+		srv := NewTCPServer(1, 1)
+		srv.SetConfig(&ServerConfig{Portmapper: mode, PortmapperRetry: 10 * time.Millisecond})
+		assert.Nil(t, srv.Serve("127.0.0.1:0"), "mode %d", mode)
+		assert.NotNil(t, srv.Addr(), "mode %d", mode)
+
+		// Let the background registration retry a few times
+		time.Sleep(30 * time.Millisecond)
+		assert.Nil(t, srv.Shutdown(context.Background()), "mode %d", mode)
+	}
+
+	srv := NewUDPServer(1, 1)
+	assert.Equal(t, ErrorPortmapperNotFound, srv.Serve("127.0.0.1:0"))
+	assert.Nil(t, srv.Addr())
+}
+
+func TestLargeMessages(t *testing.T) {
+	start := func(cfg *ServerConfig) string {
+		srv := NewTCPServer(1, 1).(*TCPServer)
+		srv.SetConfig(cfg)
+		srv.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+		srv.Register(1, func(arg []byte, reply *[]byte) error {
+			*reply = append(arg, arg...)
+			return nil
+		})
+		return serveTCP(t, srv)
+	}
+	addr := start(&ServerConfig{MaxMessageSize: 2 << 20})
+
+	data := make([]byte, 3*MaxFragmentSize)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	client := NewClient(addr, 1, 1, &ClientConfig{Transport: ClientTransportTcpOnly, MaxMessageSize: 2 << 20})
+	defer client.Close()
+
+	var reply []byte
+	assert.Nil(t, client.Call(1, data, &reply))
+	assert.Equal(t, append(data, data...), reply)
+
+	// With the default limit, the client discards the reply
+	small := NewClient(addr, 1, 1, &ClientConfig{Transport: ClientTransportTcpOnly, Timeout: 200 * time.Millisecond})
+	defer small.Close()
+	assert.NotNil(t, small.Call(1, data, &reply))
+
+	// Calls larger than the limit of the server are rejected right away, and the connection
+	// can still be used
+	client = NewClient(start(&ServerConfig{}), 1, 1, &ClientConfig{Transport: ClientTransportTcpOnly, Timeout: 5 * time.Second})
+	defer client.Close()
+	now := time.Now()
+	assert.Equal(t, &ErrGarbageArgs{}, client.Call(1, data, &reply))
+	assert.True(t, time.Since(now) < time.Second)
+	assert.Nil(t, client.Call(1, []byte{1}, &reply))
+	assert.Equal(t, []byte{1, 1}, reply)
+}
+
+func TestCallContext(t *testing.T) {
+	calls := make(chan CallContext, 1)
+	handler := func(ctx *CallContext, arg uint32, reply *uint32) error {
+		calls <- *ctx
+		*reply = arg + 1
+		return nil
+	}
+
+	tsrv := NewTCPServer(1, 2).(*TCPServer)
+	tsrv.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	tsrv.Register(3, handler)
+	taddr := serveTCP(t, tsrv)
+
+	usrv := NewUDPServer(1, 2).(*UDPServer)
+	usrv.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	usrv.Register(3, handler)
+	uaddr := serveUDP(t, usrv)
+
+	auth := &ClientAuthUnix{MachineName: "box", Uid: 1000, Gid: 100}
+
+	var contexts []context.Context
+	for _, test := range []struct {
+		addr      string
+		transport ClientTransport
+		network   string
+	}{
+		{taddr, ClientTransportTcpOnly, "tcp"},
+		{uaddr, ClientTransportUdpOnly, "udp"},
+	} {
+		client := NewClient(test.addr, 1, 2, &ClientConfig{Transport: test.transport, Auth: auth})
+		defer client.Close()
+
+		var reply uint32
+		assert.Nil(t, client.Call(3, uint32(1), &reply))
+		assert.Equal(t, uint32(2), reply)
+
+		cc := <-calls
+		assert.Equal(t, test.network, cc.Transport)
+		assert.Equal(t, test.network, cc.RemoteAddr.Network())
+		assert.Equal(t, uint32(1), cc.Program)
+		assert.Equal(t, uint32(2), cc.Version)
+		assert.Equal(t, uint32(3), cc.Procedure)
+		assert.NotEqual(t, uint32(0), cc.Xid)
+		assert.Equal(t, AuthFlavorUnix, cc.RawCred.Flavor)
+		if assert.IsType(t, AuthUnix{}, cc.Cred) {
+			assert.Equal(t, uint32(1000), cc.Cred.(AuthUnix).Uid)
+		}
+		assert.Nil(t, cc.Err())
+		contexts = append(contexts, cc.Context)
+	}
+
+	// The contexts are cancelled when the servers are closed
+	tsrv.Close()
+	usrv.Close()
+	for _, ctx := range contexts {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+			t.Fatal("context not cancelled")
+		}
+	}
+}
+
+func TestProtocolErrors(t *testing.T) {
+	s := newServer(1, 1, nil)
+	s.Register(1, func(arg uint64, reply *uint32) error { return nil })
+	s.Register(2, func(arg uint32, reply *uint32) error { return errors.New("failed") })
+	s.Register(3, typedHandler[uint64, uint32](func(ctx *CallContext, arg *uint64, reply *uint32) error { return nil }))
+
+	client := NewClient("", 1, 1, nil)
+	var reply uint32
+
+	// Arguments that can't be decoded
+	assert.Equal(t, &ErrGarbageArgs{}, roundTripRecord(t, client, &s, 1, uint32(1), &reply))
+	assert.Equal(t, &ErrGarbageArgs{}, roundTripRecord(t, client, &s, 3, nil, &reply))
+
+	// Handler errors
+	assert.Equal(t, &ErrSystem{}, roundTripRecord(t, client, &s, 2, uint32(1), &reply))
+
+	// Unsupported RPC version
+	pcall, err := client.newCall(1, 1, 1)
+	assert.Nil(t, err)
+	payload, err := encodeCall(pcall, uint64(1), true)
+	assert.Nil(t, err)
+	binary.BigEndian.PutUint32(payload[8:], 3)
+	replyBuf, err := s.handleRecord(CallContext{Context: context.Background()}, payload)
+	assert.Nil(t, err)
+	assert.Equal(t, &ErrRpcMismatch{Low: 2, High: 2}, client.readReply(&replyBuf, pcall, &reply))
+
+	// Malformed calls are dropped
+	binary.BigEndian.PutUint32(payload[8:], 2)
+	for _, payload := range [][]byte{payload[:6], payload[:20]} {
+		replyBuf, err = s.handleRecord(CallContext{Context: context.Background()}, payload)
+		assert.NotNil(t, err)
+		assert.Equal(t, 0, replyBuf.Len())
+	}
+	binary.BigEndian.PutUint32(payload[4:], uint32(ReplyMessage))
+	replyBuf, err = s.handleRecord(CallContext{Context: context.Background()}, payload)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, replyBuf.Len())
+}
+
+func TestTCPServerDropsMalformedCalls(t *testing.T) {
+	srv := NewTCPServer(1, 1).(*TCPServer)
+	srv.Register(1, func(arg uint32, reply *uint32) error {
+		*reply = arg + 1
+		return nil
+	})
+	conn, err := net.Dial("tcp", serveTCP(t, srv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// No reply is sent for the malformed call, so the first reply read is the one of the
+	// following call
+	assert.Nil(t, WriteRecord(conn, []byte{1, 2, 3, 4, 5}))
+
+	client := NewClient("", 1, 1, nil)
+	var reply uint32
+	assert.Nil(t, callConn(t, client, conn, false, 1, uint32(41), &reply))
+	assert.Equal(t, uint32(42), reply)
+}
+
+func TestHandlerErrors(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		expected error
+	}{
+		{errors.New("failed"), &ErrSystem{}},
+		{&ErrSystem{}, &ErrSystem{}},
+		{&ErrProcUnavail{}, &ErrProcUnavail{}},
+		{&ErrProgUnavail{}, &ErrProgUnavail{}},
+		{&ErrGarbageArgs{}, &ErrGarbageArgs{}},
+		{&ErrProgMismatch{Low: 1, High: 4}, &ErrProgMismatch{Low: 1, High: 4}},
+		{&ErrRpcMismatch{Low: 2, High: 2}, &ErrRpcMismatch{Low: 2, High: 2}},
+		{&ErrAuth{Stat: AuthTooWeak}, &ErrAuth{Stat: AuthTooWeak}},
+		{fmt.Errorf("access denied: %w", &ErrAuth{Stat: AuthTooWeak}), &ErrAuth{Stat: AuthTooWeak}},
+		{&RPCStatusError{Type: Accepted, Accept: ProcUnavail}, &ErrProcUnavail{}},
+		{&RPCStatusError{Type: Denied, Reject: AuthError, Auth: AuthRejectedCred}, &ErrAuth{Stat: AuthRejectedCred}},
+		{&RPCStatusError{Type: Accepted, Accept: 42}, &RPCStatusError{Type: Accepted, Accept: 42}},
+		{&RPCStatusError{Type: Accepted, Accept: Success}, &ErrSystem{}},
+	} {
+		s := newServer(1, 1, nil)
+		err := test.err
+		s.Register(1, func(arg uint32, reply *uint32) error { return err })
+
+		var reply uint32
+		client := NewClient("", 1, 1, nil)
+		assert.Equal(t, test.expected, roundTripRecord(t, client, &s, 1, uint32(1), &reply), "%v", test.err)
+	}
+
+	// The rejection is encoded with the AUTH_TOOWEAK value defined by RFC 5531
+	s := newServer(1, 1, nil)
+	s.Register(1, func(arg uint32, reply *uint32) error { return &ErrAuth{Stat: AuthTooWeak} })
+	pcall, err := NewClient("", 1, 1, nil).newCall(1, 1, 1)
+	assert.Nil(t, err)
+	payload, err := encodeCall(pcall, uint32(1), true)
+	assert.Nil(t, err)
+	reply, err := s.handleRecord(CallContext{Context: context.Background()}, payload)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{
+		0, 0, 0, 1, // REPLY
+		0, 0, 0, 1, // MSG_DENIED
+		0, 0, 0, 1, // AUTH_ERROR
+		0, 0, 0, 5, // AUTH_TOOWEAK
+	}, reply.Bytes()[4:])
+}
+
+func TestReplyEncodingError(t *testing.T) {
+	srv := NewTCPServer(1, 1).(*TCPServer)
+	srv.Register(0, func(arg struct{}, reply *struct{}) error { return nil })
+	srv.Register(1, func(arg uint32, reply *interface{}) error {
+		*reply = make(chan int)
+		return nil
+	})
+	srv.Register(2, func(arg uint32, reply *uint32) error {
+		*reply = arg + 1
+		return nil
+	})
+
+	client := NewClient(serveTCP(t, srv), 1, 1, &ClientConfig{Transport: ClientTransportTcpOnly, Timeout: time.Second})
+	defer client.Close()
+
+	// Replies that can't be encoded are replaced by SYSTEM_ERR, and the connection is still
+	// usable afterwards
+	var reply uint32
+	assert.Equal(t, &ErrSystem{}, client.Call(1, uint32(1), &reply))
+	assert.Nil(t, client.Call(2, uint32(41), &reply))
+	assert.Equal(t, uint32(42), reply)
+}
+
+func TestArgumentsSizeLimit(t *testing.T) {
+	s := newServer(1, 1, nil)
+	s.Register(1, func(arg []byte, reply *uint32) error {
+		*reply = uint32(len(arg))
+		return nil
+	})
+	s.Register(2, typedHandler[[]byte, uint32](func(ctx *CallContext, arg *[]byte, reply *uint32) error {
+		*reply = uint32(len(*arg))
+		return nil
+	}))
+
+	client := NewClient("", 1, 1, nil)
+	for _, proc := range []uint32{1, 2} {
+		var reply uint32
+		assert.Nil(t, roundTripRecord(t, client, &s, proc, make([]byte, 1000), &reply))
+		assert.Equal(t, uint32(1000), reply)
+
+		// Datagrams are only bounded by their own size, not by MaxMessageSize
+		assert.Nil(t, roundTripRecord(t, client, &s, proc, make([]byte, 40000), &reply))
+		assert.Equal(t, uint32(40000), reply)
+
+		// A bogus length of 1 GiB doesn't cause a huge allocation
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		allocated := stats.TotalAlloc
+
+		assert.Equal(t, &ErrGarbageArgs{}, roundTripRecord(t, client, &s, proc, uint32(1<<30), &reply))
+
+		runtime.ReadMemStats(&stats)
+		assert.True(t, stats.TotalAlloc-allocated < 1<<20, "allocated %d bytes", stats.TotalAlloc-allocated)
+	}
+}
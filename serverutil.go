@@ -2,38 +2,80 @@ package sunrpc
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"reflect"
+	"time"
 
 	"github.com/rasky/go-xdr/xdr2"
 )
 
 type Server interface {
-	Register(proc uint32, rcvr interface{})
-	RegisterWithName(proc uint32, rcvr interface{}, name string)
+	ProcedureRegistry
+	RegisterService(rcvr interface{}) (map[uint32]string, error)
 	SetAuth(authFun func(proc uint32, cred interface{}) bool)
+	SetAuthShort(ttl time.Duration)
+	SetConfig(cfg *ServerConfig)
 	Serve(string) error
+	Addr() net.Addr
+	Shutdown(ctx context.Context) error
+	Close() error
+}
+
+// ProcedureRegistry binds the procedures of a program version to their handlers. It is
+// implemented by servers, and by the program versions of a Dispatcher (see Dispatcher.Program).
+type ProcedureRegistry interface {
+	// Register binds a procedure to a handler function, which must look like one of these:
+	//
+	//	func(arg T1, reply *T2) error
+	//	func(ctx *CallContext, arg T1, reply *T2) error
+	//
+	// where T1 and T2 can be encoded with XDR. Functions with a different signature are
+	// rejected with an error.
+	Register(proc uint32, rcvr interface{}) error
+	RegisterWithName(proc uint32, rcvr interface{}, name string) error
 }
 
 // ReadProcedureCall reads an RPC "call" message from the given reader, ensuring the RPC message is
 // of the "call" type and specifies version '2' of the RPC protocol.
+//
+// If the message specifies a different version of the RPC protocol, an *ErrRpcMismatch error is
+// returned along with the message header, so that the caller can reply with an RPC_MISMATCH
+// error (the rest of the call body is not read).
 func ReadProcedureCall(r io.Reader) (*ProcedureCall, error) {
 	// Read RPC message header
 	message := ProcedureCall{}
 
-	if _, err := xdr.Unmarshal(r, &message); err != nil {
-		return nil, errors.New("")
+	if _, err := xdr.Unmarshal(r, &message.Header); err != nil {
+		return nil, fmt.Errorf("cannot decode RPC message header: %v", err)
 	}
 
 	// Make sure this is a "Call" message
-	if message.Header.Type != Call {
+	if message.Header.Type != CallMessage {
 		return nil, errors.New("Expected a call message")
 	}
 
 	// We can only read RPCv2 messages
+	if _, err := xdr.Unmarshal(r, &message.Body.RPCVersion); err != nil {
+		return nil, fmt.Errorf("cannot decode RPC call body: %v", err)
+	}
 	if message.Body.RPCVersion != 2 {
-		return nil, errors.New("Expected an RPC version 2 message")
+		return &message, &ErrRpcMismatch{Low: 2, High: 2}
+	}
+
+	for _, field := range []interface{}{
+		&message.Body.Program,
+		&message.Body.Version,
+		&message.Body.Procedure,
+		&message.Body.Cred,
+		&message.Body.Verf,
+	} {
+		if _, err := xdr.UnmarshalLimited(r, field, maxAuthBodySize); err != nil {
+			return nil, fmt.Errorf("cannot decode RPC call body: %v", err)
+		}
 	}
 
 	return &message, nil
@@ -42,12 +84,17 @@ func ReadProcedureCall(r io.Reader) (*ProcedureCall, error) {
 // WriteReplyMessage writes an "Accepted" RPC reply of type "Success", indicating that the procedure
 // call was successful. The given return data is written right after the RPC response header.
 func (s *server) WriteReplyMessage(w io.Writer, xid uint32, acceptType AcceptType, ret interface{}) error {
+	return s.writeReplyMessage(w, xid, OpaqueAuth{Flavor: AuthFlavorNone}, acceptType, ret)
+}
+
+// writeReplyMessage is like WriteReplyMessage, but allows to specify the reply verifier.
+func (s *server) writeReplyMessage(w io.Writer, xid uint32, verf OpaqueAuth, acceptType AcceptType, ret interface{}) error {
 	var buf bytes.Buffer
 
 	// Header
 	header := Message{
 		Xid:  xid,
-		Type: Reply,
+		Type: ReplyMessage,
 	}
 
 	if _, err := xdr.Marshal(&buf, header); err != nil {
@@ -60,14 +107,16 @@ func (s *server) WriteReplyMessage(w io.Writer, xid uint32, acceptType AcceptTyp
 	}
 
 	// "Success"
-	if _, err := xdr.Marshal(&buf, AcceptedReply{Type: acceptType}); err != nil {
+	if _, err := xdr.Marshal(&buf, AcceptedReply{Verf: verf, Type: acceptType}); err != nil {
 		return err
 	}
 
-	// Return data
+	// Return data. It is encoded before anything is written, so that if it can't be encoded,
+	// the peer receives a SYSTEM_ERR reply rather than a truncated one.
 	if ret != nil {
 		if _, err := xdr.Marshal(&buf, ret); err != nil {
-			return err
+			s.log.WithField("err", err).Error("Cannot encode procedure reply")
+			return s.writeReplyMessage(w, xid, verf, SystemErr, nil)
 		}
 	}
 
@@ -75,13 +124,47 @@ func (s *server) WriteReplyMessage(w io.Writer, xid uint32, acceptType AcceptTyp
 	return err
 }
 
+// writeReplyMessageRpcMismatch writes a "Denied" RPC reply, reporting the supported versions
+// of the RPC protocol.
+func (s *server) writeReplyMessageRpcMismatch(w io.Writer, xid uint32, low, high uint32) error {
+	var buf bytes.Buffer
+
+	// Header
+	header := Message{
+		Xid:  xid,
+		Type: ReplyMessage,
+	}
+
+	if _, err := xdr.Marshal(&buf, header); err != nil {
+		return err
+	}
+
+	// "Denied"
+	if _, err := xdr.Marshal(&buf, ReplyBody{Type: Denied}); err != nil {
+		return err
+	}
+
+	// "RpcMismatch"
+	if _, err := xdr.Marshal(&buf, RejectedReply{Stat: RpcMismatch}); err != nil {
+		return err
+	}
+
+	mismatch := struct{ Low, High uint32 }{low, high}
+	if _, err := xdr.Marshal(&buf, &mismatch); err != nil {
+		return err
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
 func (s *server) WriteReplyMessageRejectedAuth(w io.Writer, xid uint32, auth AuthStat) error {
 	var buf bytes.Buffer
 
 	// Header
 	header := Message{
 		Xid:  xid,
-		Type: Reply,
+		Type: ReplyMessage,
 	}
 
 	if _, err := xdr.Marshal(&buf, header); err != nil {
@@ -102,32 +185,47 @@ func (s *server) WriteReplyMessageRejectedAuth(w io.Writer, xid uint32, auth Aut
 		return err
 	}
 
-	return nil
+	_, err := w.Write(buf.Bytes())
+	return err
 }
 
 // callFunc Resolves and calls a real Go function given a procedure ID. The method must look
-// schematically like this (but no conformance checks are performed at runtime):
+// schematically like one of these (as verified by checkHandler at registration time):
 //
-//     func (t *T) MethodName(argType T1, replyType *T2) error
-func (s *server) callFunc(r io.Reader, receiverFunc interface{}) (interface{}, error) {
+//	func (t *T) MethodName(argType T1, replyType *T2) error
+//	func (t *T) MethodName(ctx *CallContext, argType T1, replyType *T2) error
+func (s *server) callFunc(cc *CallContext, r io.Reader, maxSize int, receiverFunc interface{}) (interface{}, error) {
+	if h, ok := receiverFunc.(handler); ok {
+		return h.call(s, cc, r, maxSize)
+	}
 
 	// Resolve function's type
 	funcType := reflect.TypeOf(receiverFunc)
 
+	// Handlers may receive the call context as first argument
+	var funcIn []reflect.Value
+	if funcType.NumIn() == 3 && funcType.In(0) == callContextType {
+		funcIn = append(funcIn, reflect.ValueOf(cc))
+	}
+	argIndex := len(funcIn)
+
 	// Deserialize arguments read from procedure call body
-	funcArg := reflect.New(funcType.In(0)).Interface()
+	funcArg := reflect.New(funcType.In(argIndex)).Interface()
 
-	if _, err := xdr.Unmarshal(r, &funcArg); err != nil {
-		return nil, err
+	// Limit the size of the decoded items, so that a bogus length can't make us allocate
+	// more memory than the call itself could possibly contain
+	if _, err := xdr.UnmarshalLimited(r, &funcArg, uint(maxSize)); err != nil {
+		s.log.WithField("err", err).Error("Cannot decode procedure arguments")
+		return nil, &ErrGarbageArgs{}
 	}
 
 	// Call function
 	funcValue := reflect.ValueOf(receiverFunc)
 	funcArgValue := reflect.Indirect(reflect.ValueOf(funcArg))
-	funcRetValue := reflect.New(funcType.In(1).Elem())
+	funcRetValue := reflect.New(funcType.In(argIndex + 1).Elem())
 
 	s.log.Debugf("-> %+v", funcArgValue)
-	funcRetError := funcValue.Call([]reflect.Value{funcArgValue, funcRetValue})[0]
+	funcRetError := funcValue.Call(append(funcIn, funcArgValue, funcRetValue))[0]
 	s.log.Debugf("<- %+v", funcRetValue)
 
 	if !funcRetError.IsNil() {
@@ -139,24 +237,115 @@ func (s *server) callFunc(r io.Reader, receiverFunc interface{}) (interface{}, e
 	return funcRetValue.Interface(), nil
 }
 
-func (o *OpaqueAuth) Decode() (interface{}, error) {
-	switch o.Flavor {
-	case AuthFlavorNone:
-		return AuthNone{}, nil
-	case AuthFlavorUnix:
-		auth := AuthUnix{}
-		_, err := xdr.Unmarshal(bytes.NewReader(o.Body), &auth)
-		if err != nil {
-			return nil, err
+var callContextType = reflect.TypeOf((*CallContext)(nil))
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// checkHandler verifies that rcvr is a function that can be called by callFunc.
+func checkHandler(rcvr interface{}) error {
+	if h, ok := rcvr.(handler); ok {
+		return h.check()
+	}
+
+	funcType := reflect.TypeOf(rcvr)
+	if funcType == nil || funcType.Kind() != reflect.Func {
+		return fmt.Errorf("handler must be a function, not %v", funcType)
+	}
+	if funcType.IsVariadic() {
+		return errors.New("handler must not be variadic")
+	}
+
+	argIndex := 0
+	switch {
+	case funcType.NumIn() == 3 && funcType.In(0) == callContextType:
+		argIndex = 1
+	case funcType.NumIn() != 2:
+		return fmt.Errorf("handler must take 2 arguments (or 3, starting with *CallContext), not %d",
+			funcType.NumIn())
+	}
+
+	if funcType.NumOut() != 1 || funcType.Out(0) != errorType {
+		return errors.New("handler must return a single error value")
+	}
+
+	argType, replyType := funcType.In(argIndex), funcType.In(argIndex+1)
+	if replyType.Kind() != reflect.Ptr {
+		return fmt.Errorf("handler reply must be a pointer, not %v", replyType)
+	}
+
+	if err := checkXDRType(argType, true, make(map[reflect.Type]bool)); err != nil {
+		return fmt.Errorf("handler argument %v: %v", argType, err)
+	}
+	if err := checkXDRType(replyType.Elem(), false, make(map[reflect.Type]bool)); err != nil {
+		return fmt.Errorf("handler reply %v: %v", replyType, err)
+	}
+	return nil
+}
+
+// checkXDRType verifies that values of type t can be encoded with XDR (and decoded, if decode
+// is true: interfaces can be encoded, but not decoded into). seen holds the struct types being
+// checked, which may refer to themselves through optional pointers.
+func checkXDRType(t reflect.Type, decode bool, seen map[reflect.Type]bool) error {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return nil
+
+	case reflect.Ptr, reflect.Array, reflect.Slice:
+		return checkXDRType(t.Elem(), decode, seen)
+
+	case reflect.Map:
+		if err := checkXDRType(t.Key(), decode, seen); err != nil {
+			return err
+		}
+		return checkXDRType(t.Elem(), decode, seen)
+
+	case reflect.Interface:
+		if decode {
+			return fmt.Errorf("type %v cannot be decoded from XDR", t)
 		}
-		return auth, nil
-	case AuthFlavorDes:
-		return nil, errors.New("unsupported DES authentication")
+		return nil
+
+	case reflect.Struct:
+		if seen[t] {
+			return nil
+		}
+		seen[t] = true
+
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue // unexported fields are ignored by XDR
+			}
+			if err := checkXDRType(field.Type, decode, seen); err != nil {
+				return fmt.Errorf("field %s: %v", field.Name, err)
+			}
+		}
+		return nil
+
 	default:
-		return nil, errors.New("unsupported authentication flavor")
+		return fmt.Errorf("type %v cannot be encoded with XDR", t)
 	}
 }
 
+// SetAuth installs a callback authorizing every call, given the procedure and its credentials,
+// as decoded by the Authenticator registered for their flavor (eg: AuthNone or AuthUnix).
 func (s *server) SetAuth(authFun func(uint32, interface{}) bool) {
 	s.authFun = authFun
 }
+
+// SetAuthShort enables the issuance of AUTH_SHORT handles: clients sending AUTH_UNIX credentials
+// receive a handle they can send in place of them. Handles expire when unused for ttl; a zero
+// ttl disables the issuance. It can be called while the server is serving, in which case the
+// handles issued so far are forgotten.
+func (s *server) SetAuthShort(ttl time.Duration) {
+	var cache *authShortCache
+	if ttl != 0 {
+		cache = newAuthShortCache(ttl)
+	}
+
+	s.shortMu.Lock()
+	s.shortCache = cache
+	s.shortMu.Unlock()
+}
@@ -1,9 +1,12 @@
 package sunrpc
 
 import (
+	"context"
+	"encoding/binary"
 	"io"
 	"net"
-	"strconv"
+	"sync"
+	"time"
 
 	"gopkg.in/Sirupsen/logrus.v0"
 )
@@ -11,6 +14,12 @@ import (
 // TCPServer is an RPC server over TCP.
 type TCPServer struct {
 	server
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool // tracked connections, true while a call is being handled
+	closing  bool
+	wg       sync.WaitGroup // accept loop and connection handlers
 }
 
 // NewTCPServer creates a new RPC server for the given program id and program version.
@@ -20,7 +29,16 @@ func NewTCPServer(program uint32, version uint32) Server {
 	}
 }
 
-// Serve starts the RPC server.
+// NewTCPServerWithDispatcher creates a new RPC server over TCP, serving all the programs and
+// versions registered in the dispatcher.
+func NewTCPServerWithDispatcher(d *Dispatcher) Server {
+	return &TCPServer{
+		server: newServerWithDispatcher(d, logrus.Fields{"proto": "tcp"}),
+	}
+}
+
+// Serve starts the RPC server. The address may specify port 0 to bind an ephemeral port: the
+// actual port is registered to the portmapper, and reported by Addr.
 func (s *TCPServer) Serve(addr string) error {
 	// Start TCP Server
 	listener, err := net.Listen("tcp4", addr)
@@ -28,71 +46,245 @@ func (s *TCPServer) Serve(addr string) error {
 		return err
 	}
 
-	// Bind to RPCBIND server
-	_, port, err := net.SplitHostPort(addr)
-	if err != nil {
-		return err
+	return s.ServeListener(listener)
+}
+
+// ServeListener starts the RPC server on a listener provided by the caller, such as a
+// listener on an IPv6 or Unix socket, a socket inherited from systemd, or a TLS listener.
+// The server takes ownership of the listener, and closes it on Shutdown or Close.
+//
+// The server is registered to the portmapper only if the listener has a TCP address.
+func (s *TCPServer) ServeListener(listener net.Listener) error {
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		if err := s.registerToPortmapper(Tcp, addr.Port); err != nil {
+			listener.Close()
+			return err
+		}
 	}
 
-	portAsInt, err := strconv.Atoi(port)
-	if err != nil {
-		return err
+	return s.serve(listener)
+}
+
+// Addr returns the address the server is listening on, or nil if it is not serving yet.
+func (s *TCPServer) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
 	}
+	return s.listener.Addr()
+}
 
-	if err := s.registerToPortmapper(Tcp, portAsInt); err != nil {
-		return err
+// Shutdown gracefully stops the server: it stops accepting new connections, closes idle
+// connections, waits for in-flight calls to complete, and unregisters from the portmapper.
+// If ctx expires before in-flight calls are complete, the remaining connections are forcibly
+// closed and ctx.Err() is returned.
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	if s.listener != nil {
+		s.listener.Close()
 	}
+	for conn, active := range s.conns {
+		if !active {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
 
-	// Handle incoming connections
+	done := make(chan struct{})
 	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				s.server.log.WithField("err", err).Error("Unable to accept incoming connection. Ignoring")
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.server.cancel()
+		return s.unregisterFromPortmapper()
+	case <-ctx.Done():
+		s.Close()
+		return ctx.Err()
+	}
+}
+
+// Close immediately stops the server, closing the listener and all the connections, and
+// unregisters from the portmapper.
+func (s *TCPServer) Close() error {
+	s.mu.Lock()
+	s.closing = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.server.cancel()
+
+	return s.unregisterFromPortmapper()
+}
+
+//
+// Private
+//
+
+// serve handles the incoming connections on listener, in background.
+func (s *TCPServer) serve(listener net.Listener) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		listener.Close()
+		return ErrorServerClosed
+	}
+
+	s.listener = listener
+	s.conns = make(map[net.Conn]bool)
+
+	s.wg.Add(1)
+	go s.acceptLoop(listener)
+
+	return nil
+}
+
+func (s *TCPServer) acceptLoop(listener net.Listener) {
+	defer s.wg.Done()
 
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isClosing() {
+				return
+			}
+
+			// Back off on temporary errors (eg: too many open files), rather than spinning
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				s.server.log.WithField("err", err).Error("Unable to accept incoming connection. Retrying")
+				time.Sleep(delay)
 				continue
 			}
 
-			s.server.log.WithField("remote", conn.RemoteAddr().String()).Debug("Client connected.")
+			s.server.log.WithField("err", err).Error("Unable to accept incoming connection. Stopping")
+			return
+		}
+		delay = 0
 
-			go s.handleCall(conn)
+		s.server.log.WithField("remote", conn.RemoteAddr().String()).Debug("Client connected.")
+
+		if !s.trackConn(conn) {
+			conn.Close()
+			return
 		}
-	}()
+		go s.handleCall(conn)
+	}
+}
 
-	return nil
+func (s *TCPServer) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
 }
 
-//
-// Private
-//
+// trackConn starts tracking a new connection, unless the server is closing.
+func (s *TCPServer) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = false
+	s.wg.Add(1)
+	return true
+}
+
+// setActive marks a connection as handling a call (or not). It returns false if the
+// connection should be closed because the server is shutting down.
+func (s *TCPServer) setActive(conn net.Conn, active bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, tracked := s.conns[conn]; tracked {
+		s.conns[conn] = active
+	}
+	return !s.closing
+}
 
 func (s *TCPServer) handleCall(conn net.Conn) {
 	defer func() {
 		s.server.log.WithField("remote", conn.RemoteAddr().String()).Debug("Closing connection.")
 
 		conn.Close()
+
+		s.mu.Lock()
+		if _, tracked := s.conns[conn]; tracked {
+			delete(s.conns, conn)
+			s.wg.Done()
+		}
+		s.mu.Unlock()
 	}()
 
+	cc := CallContext{
+		Context:    s.server.ctx,
+		RemoteAddr: conn.RemoteAddr(),
+		Transport:  conn.LocalAddr().Network(),
+	}
+
+	// Calls are decoded while they are read, and replies are sent in fragments as they are written
+	rr := NewRecordReader(conn, s.server.cfg.MaxMessageSize)
+	rw := NewRecordWriter(conn)
+
 	for {
-		// Make sure to read a whole record at a time.
-		record, err := ReadRecord(conn)
+		// Wait for the next call, skipping what is left of the previous one
+		err := rr.Next()
+		if err == ErrorRecordTooLarge {
+			// The record will be skipped, the connection can still be used. Reply with
+			// GARBAGE_ARGS, so that the client doesn't wait for a reply until it times out.
+			s.server.log.WithField("err", err).Warn("Discarding call")
+			var header [8]byte
+			if rr.readTooLarge(header[:]) != nil || MessageType(binary.BigEndian.Uint32(header[4:])) != CallMessage {
+				continue
+			}
+			xid := binary.BigEndian.Uint32(header[:])
+			if err := s.server.WriteReplyMessage(rw, xid, GarbageArgs, nil); err != nil {
+				s.server.log.WithField("err", err).Error("handling record")
+			}
+			if err := rw.Close(); err != nil {
+				s.server.log.Error(err)
+				return
+			}
+			continue
+		}
 		if err != nil {
-			if err == io.EOF {
+			if err == io.EOF || s.isClosing() {
 				return
 			}
 			s.server.log.WithField("err", err).Error("Unable to read a record")
 			return
 		}
 
-		reply, err := s.server.handleRecord(record.Bytes())
-		if err != nil {
+		s.setActive(conn, true)
+
+		if err := s.server.handleStream(cc, rr, rw, s.server.cfg.MaxMessageSize); err != nil {
 			s.server.log.WithField("err", err).Error("handling record")
 		}
 
 		// Send response
-		if err := WriteTCPReplyMessage(conn, reply.Bytes()); err != nil {
+		if err := rw.Close(); err != nil {
 			s.server.log.Error(err)
 			return
 		}
+
+		if !s.setActive(conn, false) {
+			return
+		}
 	}
 }
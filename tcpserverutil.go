@@ -10,9 +10,18 @@ import (
 )
 
 const (
-	maxRecordSize = 32 * 1024
+	// DefaultMaxRecordSize is the maximum size of a record read by ReadRecord.
+	DefaultMaxRecordSize = 32 * 1024
+
+	// MaxFragmentSize is the maximum size of the fragments written by WriteRecord: larger records
+	// are split in multiple fragments.
+	MaxFragmentSize = 64 * 1024
 )
 
+// ErrorRecordTooLarge is returned by ReadRecordLimit when a record exceeds the maximum size. The
+// whole record is discarded, so that the following one can be read.
+var ErrorRecordTooLarge = errors.New("RPC record exceeds the maximum size")
+
 // NewRecordMarker creates a new record marker as described in RFC 5531.
 //
 // "When RPC messages are passed on top of a byte stream transport protocol (like TCP), it is
@@ -70,8 +79,15 @@ func WriteRecordMarker(w io.Writer, size uint32, last bool) error {
 
 // ReadRecord reads a whole record into memory (up to 32 KB), otherwise the record is discarded.
 func ReadRecord(r io.Reader) (*bytes.Buffer, error) {
+	return ReadRecordLimit(r, DefaultMaxRecordSize)
+}
+
+// ReadRecordLimit reads a whole record into memory, joining all its fragments. If the record
+// exceeds maxSize bytes, it is discarded and ErrorRecordTooLarge is returned.
+func ReadRecordLimit(r io.Reader, maxSize int) (*bytes.Buffer, error) {
 
 	var buf bytes.Buffer
+	discard := false
 
 	for {
 		size, last, err := ReadRecordMarker(r)
@@ -81,16 +97,16 @@ func ReadRecord(r io.Reader) (*bytes.Buffer, error) {
 		}
 
 		if size < 1 {
-			return nil, errors.New("A TCP record must be at least one byte in size")
-		}
-
-		if size >= maxRecordSize {
-			io.CopyN(ioutil.Discard, r, int64(size))
-
-			return nil, fmt.Errorf("Discarded record exceeding maximum size of %v bytes", maxRecordSize)
+			return nil, errEmptyFragment
 		}
 
-		if n, err := io.CopyN(&buf, r, int64(size)); err != nil {
+		if discard || buf.Len()+int(size) > maxSize {
+			// Skip the rest of the record, to stay in sync with the stream
+			if n, err := io.CopyN(ioutil.Discard, r, int64(size)); err != nil {
+				return nil, fmt.Errorf("Unable to read entire record. Read %v, expected %v", n, size)
+			}
+			discard = true
+		} else if n, err := io.CopyN(&buf, r, int64(size)); err != nil {
 			return nil, fmt.Errorf("Unable to read entire record. Read %v, expected %v", n, size)
 		}
 
@@ -99,24 +115,47 @@ func ReadRecord(r io.Reader) (*bytes.Buffer, error) {
 		}
 	}
 
+	if discard {
+		return nil, ErrorRecordTooLarge
+	}
+
 	return &buf, nil
 }
 
-// WriteTCPReplyMessage writes an outgoing "reply" message with the appropriate framing structure
-// required by RPC-over-TCP.
-func WriteTCPReplyMessage(w io.Writer, reply []byte) error {
-
-	// Write the record marker
-	//
-	// FIXME: Assuming we are sending a single record
-	if err := WriteRecordMarker(w, uint32(len(reply)), true); err != nil {
-		return err
+// appendRecord appends a record to buf, split in fragments of up to MaxFragmentSize bytes,
+// each one preceded by its record marker.
+func appendRecord(buf []byte, record []byte) []byte {
+	if buf == nil {
+		buf = make([]byte, 0, len(record)+4*(len(record)/MaxFragmentSize+1))
 	}
 
-	// Write the payload
-	if _, err := w.Write(reply); err != nil {
-		return err
+	for {
+		size := len(record)
+		last := size <= MaxFragmentSize
+		if !last {
+			size = MaxFragmentSize
+		}
+
+		buf = binary.BigEndian.AppendUint32(buf, NewRecordMarker(uint32(size), last))
+		buf = append(buf, record[:size]...)
+		record = record[size:]
+
+		if last {
+			return buf
+		}
 	}
+}
 
-	return nil
+// WriteRecord writes a record with the framing structure required by RPC-over-TCP, splitting it
+// in multiple fragments if it is larger than MaxFragmentSize. The record is sent with a single
+// Write call.
+func WriteRecord(w io.Writer, record []byte) error {
+	_, err := w.Write(appendRecord(nil, record))
+	return err
+}
+
+// WriteTCPReplyMessage writes an outgoing "reply" message with the appropriate framing structure
+// required by RPC-over-TCP.
+func WriteTCPReplyMessage(w io.Writer, reply []byte) error {
+	return WriteRecord(w, reply)
 }
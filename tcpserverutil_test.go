@@ -2,6 +2,7 @@ package sunrpc
 
 import (
 	"bytes"
+	"encoding/binary"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -87,3 +88,40 @@ func TestReadTCPCallMessage(t *testing.T) {
 	assert.EqualValues(t, PortmapperVersion, call.Body.Version)
 	assert.EqualValues(t, PortmapperPortSet, call.Body.Procedure)
 }
+
+func TestWriteRecordFragments(t *testing.T) {
+	var buf bytes.Buffer
+
+	record := make([]byte, 2*MaxFragmentSize+10)
+	for i := range record {
+		record[i] = byte(i)
+	}
+	assert.Nil(t, WriteRecord(&buf, record))
+
+	// Three fragments, only the last one is marked as such
+	data := buf.Bytes()
+	assert.Equal(t, NewRecordMarker(MaxFragmentSize, false), binary.BigEndian.Uint32(data))
+	data = data[4+MaxFragmentSize:]
+	assert.Equal(t, NewRecordMarker(MaxFragmentSize, false), binary.BigEndian.Uint32(data))
+	data = data[4+MaxFragmentSize:]
+	assert.Equal(t, NewRecordMarker(10, true), binary.BigEndian.Uint32(data))
+
+	read, err := ReadRecordLimit(&buf, len(record))
+	assert.Nil(t, err)
+	assert.Equal(t, record, read.Bytes())
+}
+
+func TestReadRecordTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+
+	WriteRecord(&buf, make([]byte, MaxFragmentSize+1))
+	WriteRecord(&buf, []byte{1, 2, 3, 4})
+
+	_, err := ReadRecordLimit(&buf, MaxFragmentSize)
+	assert.Equal(t, ErrorRecordTooLarge, err)
+
+	// The large record was skipped entirely
+	read, err := ReadRecordLimit(&buf, MaxFragmentSize)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 4}, read.Bytes())
+}
@@ -0,0 +1,75 @@
+package sunrpc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/rasky/go-xdr/xdr2"
+)
+
+// handler is implemented by procedures that can decode their arguments and run without going
+// through reflection, such as those registered with RegisterFunc.
+type handler interface {
+	call(s *server, cc *CallContext, r io.Reader, maxSize int) (interface{}, error)
+	check() error
+}
+
+// typedHandler is a handler wrapping a function with statically known argument and reply types.
+type typedHandler[Arg, Reply any] func(ctx *CallContext, arg *Arg, reply *Reply) error
+
+func (fn typedHandler[Arg, Reply]) call(s *server, cc *CallContext, r io.Reader, maxSize int) (interface{}, error) {
+	arg := new(Arg)
+	if _, err := xdr.UnmarshalLimited(r, arg, uint(maxSize)); err != nil {
+		s.log.WithField("err", err).Error("Cannot decode procedure arguments")
+		return nil, &ErrGarbageArgs{}
+	}
+
+	reply := new(Reply)
+	s.log.Debugf("-> %+v", arg)
+	if err := fn(cc, arg, reply); err != nil {
+		return nil, err
+	}
+	s.log.Debugf("<- %+v", reply)
+	return reply, nil
+}
+
+func (fn typedHandler[Arg, Reply]) check() error {
+	if fn == nil {
+		return fmt.Errorf("handler must be a function, not nil")
+	}
+
+	argType := reflect.TypeOf((*Arg)(nil)).Elem()
+	if err := checkXDRType(argType, true, make(map[reflect.Type]bool)); err != nil {
+		return fmt.Errorf("handler argument %v: %v", argType, err)
+	}
+	replyType := reflect.TypeOf((*Reply)(nil)).Elem()
+	if err := checkXDRType(replyType, false, make(map[reflect.Type]bool)); err != nil {
+		return fmt.Errorf("handler reply %v: %v", replyType, err)
+	}
+	return nil
+}
+
+// RegisterFunc binds a procedure of r (a server, or a program version of a Dispatcher) to a
+// function with typed argument and reply. Unlike handlers registered with Server.Register, the
+// function is type-checked at compile time, and calls are dispatched without reflection.
+func RegisterFunc[Arg, Reply any](r ProcedureRegistry, proc uint32, fn func(ctx *CallContext, arg *Arg, reply *Reply) error) error {
+	return r.Register(proc, typedHandler[Arg, Reply](fn))
+}
+
+// RegisterFuncWithName is like RegisterFunc, but also assigns a name to the procedure (used for
+// logging).
+func RegisterFuncWithName[Arg, Reply any](r ProcedureRegistry, proc uint32, fn func(ctx *CallContext, arg *Arg, reply *Reply) error, name string) error {
+	return r.RegisterWithName(proc, typedHandler[Arg, Reply](fn), name)
+}
+
+// Call is the typed counterpart of Client.CallContext: it calls a procedure with the
+// specified argument, and returns its reply.
+func Call[Arg, Reply any](ctx context.Context, c *Client, proc uint32, arg *Arg) (*Reply, error) {
+	reply := new(Reply)
+	if err := c.CallContext(ctx, proc, arg, reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
@@ -0,0 +1,79 @@
+package sunrpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type typedArgs struct {
+	Name  string
+	Items []uint32
+}
+
+type typedReply struct {
+	Greeting string
+	Sum      uint64
+}
+
+func TestRegisterFunc(t *testing.T) {
+	srv := NewTCPServer(1, 2).(*TCPServer)
+	assert.Nil(t, RegisterFunc(srv, 0, func(ctx *CallContext, arg *struct{}, reply *struct{}) error { return nil }))
+	assert.Nil(t, RegisterFuncWithName(srv, 1, func(ctx *CallContext, arg *typedArgs, reply *typedReply) error {
+		reply.Greeting = "hello " + arg.Name
+		for _, item := range arg.Items {
+			reply.Sum += uint64(item)
+		}
+		return nil
+	}, "GREET"))
+	assert.Nil(t, RegisterFunc(srv, 2, func(ctx *CallContext, arg *uint32, reply *uint32) error {
+		if ctx.Procedure != 2 {
+			return errors.New("wrong procedure")
+		}
+		return errors.New("failed")
+	}))
+
+	// Types that can't be encoded are rejected
+	assert.NotNil(t, RegisterFunc(srv, 3, func(ctx *CallContext, arg *chan int, reply *uint32) error { return nil }))
+	assert.NotNil(t, RegisterFunc[uint32, uint32](srv, 3, nil))
+
+	client := NewClient(serveTCP(t, srv), 1, 2, &ClientConfig{Transport: ClientTransportTcpOnly})
+	defer client.Close()
+
+	reply, err := Call[typedArgs, typedReply](context.Background(), client, 1, &typedArgs{Name: "world", Items: []uint32{1, 2, 3}})
+	assert.Nil(t, err)
+	assert.Equal(t, &typedReply{Greeting: "hello world", Sum: 6}, reply)
+
+	arg := uint32(1)
+	_, err = Call[uint32, uint32](context.Background(), client, 2, &arg)
+	assert.NotNil(t, err)
+
+	_, err = Call[uint32, uint32](context.Background(), client, 3, &arg)
+	assert.Equal(t, &ErrProcUnavail{}, err)
+}
+
+func TestRegisterFuncDispatcher(t *testing.T) {
+	d := NewDispatcher()
+	assert.Nil(t, RegisterFunc(d.Program(1, 3), 1, func(ctx *CallContext, arg *uint32, reply *uint32) error {
+		*reply = *arg + ctx.Version
+		return nil
+	}))
+	assert.Nil(t, RegisterFuncWithName(d.Program(2, 1), 1, func(ctx *CallContext, arg *string, reply *string) error {
+		*reply = "hello " + *arg
+		return nil
+	}, "GREET"))
+	assert.NotNil(t, RegisterFunc[uint32, uint32](d.Program(3, 1), 1, nil))
+	assert.Equal(t, []ProgramVersion{{Program: 1, Version: 3}, {Program: 2, Version: 1}}, d.Programs())
+
+	s := newServerWithDispatcher(d, nil)
+
+	var reply uint32
+	assert.Nil(t, roundTripRecord(t, NewClient("", 1, 3, nil), &s, 1, uint32(39), &reply))
+	assert.Equal(t, uint32(42), reply)
+
+	var greeting string
+	assert.Nil(t, roundTripRecord(t, NewClient("", 2, 1, nil), &s, 1, "world", &greeting))
+	assert.Equal(t, "hello world", greeting)
+}
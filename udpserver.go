@@ -1,8 +1,9 @@
 package sunrpc
 
 import (
+	"context"
 	"net"
-	"strconv"
+	"sync"
 
 	"gopkg.in/Sirupsen/logrus.v0"
 )
@@ -13,6 +14,11 @@ const MaxUdpSize = 65507
 // UDPServer is an RPC server over UDP.
 type UDPServer struct {
 	server
+
+	mu      sync.Mutex
+	conn    net.PacketConn
+	closing bool
+	done    chan struct{} // closed when the read loop exits
 }
 
 // NewUDPServer creates a new UDPServer for the given RPC program identifier and program version.
@@ -22,71 +28,186 @@ func NewUDPServer(program uint32, version uint32) Server {
 	}
 }
 
-// Serve starts the RPC server.
-func (server *UDPServer) Serve(addr string) error {
-	// Parse and deconstruct host and port
-	host, portString, err := net.SplitHostPort(addr)
-	if err != nil {
-		return err
+// NewUDPServerWithDispatcher creates a new RPC server over UDP, serving all the programs and
+// versions registered in the dispatcher.
+func NewUDPServerWithDispatcher(d *Dispatcher) Server {
+	return &UDPServer{
+		server: newServerWithDispatcher(d, logrus.Fields{"proto": "udp"}),
 	}
+}
 
-	port, err := strconv.Atoi(portString)
+// Serve starts the RPC server. The address may specify port 0 to bind an ephemeral port: the
+// actual port is registered to the portmapper, and reported by Addr.
+func (server *UDPServer) Serve(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
 	if err != nil {
 		return err
 	}
 
 	// Start UDP Server
-	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(host), Port: port})
+	conn, err := net.ListenUDP("udp4", udpAddr)
 	if err != nil {
 		return err
 	}
 
 	if err := conn.SetReadBuffer(MaxUdpSize); err != nil {
+		conn.Close()
 		return err
 	}
 	if err := conn.SetWriteBuffer(MaxUdpSize); err != nil {
+		conn.Close()
 		return err
 	}
 
-	if err := server.registerToPortmapper(Udp, port); err != nil {
-		return err
+	return server.ServePacketConn(conn)
+}
+
+// ServePacketConn starts the RPC server on a packet connection provided by the caller, such
+// as an IPv6 or Unix datagram socket, or a socket inherited from systemd. The server takes
+// ownership of the connection, and closes it on Shutdown or Close.
+//
+// The server is registered to the portmapper only if the connection has a UDP address.
+func (server *UDPServer) ServePacketConn(conn net.PacketConn) error {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		if err := server.registerToPortmapper(Udp, addr.Port); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	return server.serve(conn)
+}
+
+// Addr returns the address the server is listening on, or nil if it is not serving yet.
+func (s *UDPServer) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+// Shutdown gracefully stops the server: it stops reading new calls, waits for the in-flight
+// call (if any) to complete, closes the socket and unregisters from the portmapper. If ctx
+// expires before that, the socket is forcibly closed and ctx.Err() is returned.
+func (s *UDPServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	conn, done := s.conn, s.done
+	s.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+
+	// Wake up the read loop, if it is waiting for a datagram
+	conn.SetReadDeadline(aLongTimeAgo)
+
+	select {
+	case <-done:
+		conn.Close()
+		s.server.cancel()
+		return s.unregisterFromPortmapper()
+	case <-ctx.Done():
+		s.Close()
+		return ctx.Err()
+	}
+}
+
+// Close immediately stops the server, closing the socket, and unregisters from the portmapper.
+func (s *UDPServer) Close() error {
+	s.mu.Lock()
+	s.closing = true
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.mu.Unlock()
+	s.server.cancel()
+
+	return s.unregisterFromPortmapper()
+}
+
+//
+// Private
+//
+
+// serve handles the incoming calls on conn, in background.
+func (s *UDPServer) serve(conn net.PacketConn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		conn.Close()
+		return ErrorServerClosed
 	}
 
+	s.conn = conn
+	s.done = make(chan struct{})
+
 	go func() {
+		defer close(s.done)
 		for {
-			server.handleCall(conn)
+			err := s.handleCall(conn)
+			if err == nil {
+				continue
+			}
+			if s.isClosing() {
+				return
+			}
+
+			// Deadlines are only set by Shutdown; any other error (eg: the socket was closed
+			// by the caller) is permanent, so stop rather than spinning
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				continue
+			}
+			s.server.log.WithField("err", err).Error("Cannot read UDP datagram. Stopping")
+			return
 		}
 	}()
 
 	return nil
 }
 
-//
-// Private
-//
+func (s *UDPServer) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
 
-func (s *UDPServer) handleCall(conn *net.UDPConn) {
+// handleCall reads a call and sends back the reply. It only returns an error if no datagram
+// could be read.
+func (s *UDPServer) handleCall(conn net.PacketConn) error {
 	// Read and buffer UDP datagram
 	b := make([]byte, MaxUdpSize)
 
-	packetSize, callerAddr, err := conn.ReadFromUDP(b)
+	packetSize, callerAddr, err := conn.ReadFrom(b)
 	if err != nil {
-		s.server.log.WithField("err", err).Error("Cannot read UDP datagram")
+		return err
+	}
 
-		return
+	cc := CallContext{
+		Context:    s.server.ctx,
+		RemoteAddr: callerAddr,
+		Transport:  conn.LocalAddr().Network(),
 	}
 
-	reply, err := s.server.handleRecord(b[0:packetSize])
+	reply, err := s.server.handleRecord(cc, b[0:packetSize])
 	if err != nil {
 		s.server.log.WithField("err", err).Error("handling record")
 	}
 
-	if _, err := conn.WriteToUDP(reply.Bytes(), callerAddr); err != nil {
+	if reply.Len() == 0 {
+		return nil
+	}
+
+	if _, err := conn.WriteTo(reply.Bytes(), callerAddr); err != nil {
 		s.server.log.WithFields(logrus.Fields{
 			"callerAddr": callerAddr.String(),
 			"err":        err,
 		}).Error("Cannot send reply over UDP")
-
-		return
 	}
+
+	return nil
 }